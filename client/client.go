@@ -0,0 +1,203 @@
+package client
+
+import (
+	"FtpClient/common"
+	"FtpClient/downloader"
+	"FtpClient/uploader"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrSkipped 目标文件已存在且OnExist为skip，没有下载
+var ErrSkipped = errors.New("target file exists, download skipped")
+
+// Client 文件传输客户端，持有服务地址、http客户端以及分片大小、并发数、超时时间等参数，
+// 可以在同一进程中创建多个Client访问不同的服务端
+type Client struct {
+	common.Config // 客户端配置
+}
+
+// NewClient 新建一个客户端，serverAddr为ip:port或者完整的http地址
+func NewClient(serverAddr string) *Client {
+	baseUrl := serverAddr
+	if !strings.HasPrefix(baseUrl, "http://") && !strings.HasPrefix(baseUrl, "https://") {
+		baseUrl = "http://" + baseUrl
+	}
+	if !strings.HasSuffix(baseUrl, "/") {
+		baseUrl += "/"
+	}
+
+	return &Client{
+		Config: *common.NewConfig(baseUrl),
+	}
+}
+
+// Upload 上传文件，服务端以文件的基本名保存，小文件整个上传，大文件切片上传并支持断点续传，返回文件大小
+func (c *Client) Upload(ctx context.Context, filePath string) (int64, error) {
+	return c.UploadAs(ctx, filePath, filepath.Base(filePath))
+}
+
+// UploadAs 上传文件，服务端以filename保存，filename可以是以/分隔的相对路径，服务端会创建其中的目录
+func (c *Client) UploadAs(ctx context.Context, filePath string, filename string) (int64, error) {
+	err := common.CheckPath("filename", filename)
+	if err != nil {
+		return 0, err
+	}
+
+	fileStat, err := os.Stat(filePath)
+	if err != nil {
+		c.Log().Error("file.stat_failed", "path", filePath, "err", err)
+		return 0, err
+	}
+	if fileStat.IsDir() {
+		return 0, errors.New(filePath + ": is a directory, cannot upload")
+	}
+	return fileStat.Size(), c.upload(ctx, filePath, filename, fileStat.Size())
+}
+
+func (c *Client) upload(ctx context.Context, filePath string, filename string, filesize int64) error {
+	// 如果不超过整个上传的上限则整个文件上传，否则采用分片方式上传
+	if filesize <= c.SingleUploadLimit(ctx) {
+		return uploader.UploadFile(ctx, &c.Config, filePath, filename)
+	}
+
+	// 这里需要判断是否是上传到一半的文件，如果是则重新加载上传器，如果不是则重新创建上传器当新文件进行上传
+	uloader := uploader.GetUploader(ctx, &c.Config, filePath, filename)
+	if uloader == nil {
+		c.Log().Info("upload.new", "path", filePath)
+		uloader = uploader.NewUploader(&c.Config, filePath, filename)
+	}
+	if uloader == nil {
+		c.Log().Error("upload.create_failed", "path", filePath)
+		return errors.New("failed to create uploader")
+	}
+
+	// 切片方式进行文件上传
+	return uloader.UploadFileBySlice(ctx)
+}
+
+// Download 下载文件到downloadDir目录，根据文件类型选择整个下载或切片下载，返回文件大小。
+// filename可以是以/分隔的相对路径，会在downloadDir下创建对应的目录；
+// 目标文件已存在且OnExist为skip时返回ErrSkipped，文件名会写到下载目录之外时返回*common.UnsafeNameError
+func (c *Client) Download(ctx context.Context, filename string, downloadDir string) (int64, error) {
+	targetPath, err := common.SafeJoin(downloadDir, "filename", filename)
+	if err != nil {
+		return 0, err
+	}
+
+	// 目标文件已存在且不需要覆盖时，不必再下载
+	if c.OnExist == common.OnExistSkip && common.IsFile(targetPath) {
+		c.Log().Info("download.skipped", "file", filename)
+		return 0, ErrSkipped
+	}
+
+	fileInfo, err := c.Stat(ctx, filename)
+	if err != nil {
+		return 0, err
+	}
+	if dir := filepath.Dir(targetPath); common.IsDir(downloadDir) && !common.IsDir(dir) {
+		err = os.MkdirAll(dir, 0766)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return fileInfo.Filesize, c.download(ctx, filename, fileInfo.Filetype, downloadDir)
+}
+
+func (c *Client) download(ctx context.Context, filename string, filetype string, downloadDir string) error {
+	switch filetype {
+	case "normal":
+		// 普通文件，直接整个下载
+		return downloader.DownloadFile(ctx, &c.Config, filename, downloadDir)
+	case "slice":
+		// 这里需要判断是否是下载到一半的文件，如果是则重新加载下载器，如果不是则重新创建下载器进行下载
+		dLoader := downloader.GetDownLoader(ctx, &c.Config, filename, downloadDir)
+		if dLoader == nil {
+			c.Log().Info("download.new", "file", filename)
+			var err error
+			dLoader, err = downloader.NewDownLoader(ctx, &c.Config, filename, downloadDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := dLoader.DownloadFileBySlice(ctx)
+		if err != nil {
+			return err
+		}
+
+		// 合并分片
+		return dLoader.MergeDownloadFiles()
+	default:
+		c.Log().Error("download.unknown_type", "file", filename, "type", filetype)
+		return errors.New("unknown file type: " + filetype)
+	}
+}
+
+// 发起GET请求并将返回的json解析到v中
+func (c *Client) getJson(ctx context.Context, targetUrl string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", targetUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errMsg, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(errMsg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// List 获取服务端文件列表
+func (c *Client) List(ctx context.Context) (*common.ListFileInfos, error) {
+	var fileinfos common.ListFileInfos
+	err := c.getJson(ctx, c.Url("listFiles", nil), &fileinfos)
+	if err != nil {
+		c.Log().Error("client.list_failed", "err", err)
+		return nil, err
+	}
+	return &fileinfos, nil
+}
+
+// Stat 获取文件基本信息，用以判断是普通类型文件还是切片类型文件
+func (c *Client) Stat(ctx context.Context, filename string) (*common.FileInfo, error) {
+	var baseInfo common.FileInfo
+	err := c.getJson(ctx, c.Url("getFileInfo", url.Values{"filename": {filename}}), &baseInfo)
+	if err != nil {
+		c.Log().Error("client.stat_failed", "file", filename, "err", err)
+		return nil, err
+	}
+	return &baseInfo, nil
+}
+
+// Delete 删除服务端文件
+func (c *Client) Delete(ctx context.Context, filename string) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Url("delete", url.Values{"filename": {filename}}), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errMsg, _ := ioutil.ReadAll(resp.Body)
+		c.Log().Error("client.delete_failed", "file", filename, "status", resp.StatusCode)
+		return errors.New(strings.TrimSpace(string(errMsg)))
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 自适应调整的范围
+const AdaptiveMaxNumPerFile = 64               // 自适应时每个文件并发分片数的上限
+const AdaptiveMinSliceBytes = 256 * 1024       // 自适应选择的最小分片大小
+const AdaptiveMaxSliceBytes = 64 * 1024 * 1024 // 自适应选择的最大分片大小
+const AdaptiveSliceDuration = 2 * time.Second  // 期望单个分片的传输时间
+const adaptiveMinSamples = 8                   // 历史样本少于该数量时不调整分片大小
+const adaptiveLatencyFactor = 2                // 单位数据时延超过基准的倍数时认为出现拥塞
+const adaptiveErrorRate = 0.1                  // 出错率超过该值时减小分片大小
+const adaptiveEwmaWeight = 0.2                 // 历史统计中新样本的权重
+
+// SliceSample 一次分片请求的观测结果
+type SliceSample struct {
+	Bytes   int64         // 传输的字节数
+	Latency time.Duration // 从发出请求到传输完成的时间
+	Err     bool          // 请求是否失败
+}
+
+// Concurrency 单个文件的分片并发控制，固定模式下并发数不变，
+// 自适应模式下按AIMD调整：请求成功且时延正常时每轮加1，失败或时延明显变大时减半
+type Concurrency struct {
+	lock         sync.Mutex
+	adaptive     bool
+	limit        float64          // 当前允许的并发数
+	max          float64          // 并发数上限
+	inflight     int              // 进行中的分片请求数
+	waiters      waitQueue        // 等待名额的分片请求
+	baseRate     float64          // 观测到的正常单位数据时延，秒每字节
+	lastDecrease time.Time        // 上次减小并发数的时间，同一轮中的多次拥塞只减一次
+	history      *TransferHistory // 记录观测结果，用于后续选择分片大小
+}
+
+// NewConcurrency 新建一个并发控制，adaptive为false时并发数固定为limit
+func NewConcurrency(limit int, max int, adaptive bool, history *TransferHistory) *Concurrency {
+	if limit < 1 {
+		limit = 1
+	}
+	if max < limit {
+		max = limit
+	}
+	return &Concurrency{
+		adaptive: adaptive,
+		limit:    float64(limit),
+		max:      float64(max),
+		history:  history,
+	}
+}
+
+// Limit 当前允许的并发数
+func (c *Concurrency) Limit() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return int(c.limit)
+}
+
+// Acquire 获取一个分片请求名额，ctx取消时放弃等待并返回ctx.Err()
+func (c *Concurrency) Acquire(ctx context.Context) error {
+	c.lock.Lock()
+	if c.inflight < int(c.limit) && c.waiters.len() == 0 {
+		c.inflight++
+		c.lock.Unlock()
+		return nil
+	}
+	waiter := c.waiters.push()
+	c.lock.Unlock()
+	return c.waiters.wait(ctx, &c.lock, waiter, c.release)
+}
+
+// Release 归还Acquire获取的名额
+func (c *Concurrency) Release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.release()
+}
+
+// 归还名额并唤醒等待中的请求，调用时需要持有锁
+func (c *Concurrency) release() {
+	c.inflight--
+	c.wake()
+}
+
+// 并发数允许时唤醒等待中的请求，调用时需要持有锁
+func (c *Concurrency) wake() {
+	for c.waiters.len() > 0 && c.inflight < int(c.limit) {
+		c.inflight++
+		c.waiters.grant()
+	}
+}
+
+// Observe 记录一次分片请求的结果，自适应模式下据此调整并发数
+func (c *Concurrency) Observe(sample SliceSample) {
+	c.history.Record(sample)
+	if !c.adaptive || (sample.Bytes <= 0 && !sample.Err) {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	congested := sample.Err
+	if !sample.Err {
+		rate := sample.Latency.Seconds() / float64(sample.Bytes)
+		if c.baseRate == 0 || rate < c.baseRate {
+			c.baseRate = rate
+		} else {
+			// 基准缓慢跟随网络变化
+			c.baseRate += (rate - c.baseRate) / 64
+		}
+		congested = rate > c.baseRate*adaptiveLatencyFactor
+	}
+
+	if congested {
+		// 乘性减小，一轮请求内只减一次，避免一批请求同时出错时降到最低
+		if time.Since(c.lastDecrease) > sample.Latency {
+			c.limit = math.Max(1, c.limit/2)
+			c.lastDecrease = time.Now()
+		}
+		return
+	}
+
+	// 加性增加，每轮请求加1
+	c.limit = math.Min(c.max, c.limit+1/c.limit)
+	c.wake()
+}
+
+// TransferHistory 最近传输的观测统计，用于为新上传的文件选择分片大小，
+// 指定了保存路径时可以跨进程保留，传输全部结束后调用Save保存
+type TransferHistory struct {
+	lock       sync.Mutex
+	saveLock   sync.Mutex // 保证同时只有一个Save在写文件
+	path       string
+	Throughput float64 // 单个分片请求的平均吞吐量，字节每秒
+	ErrorRate  float64 // 分片请求的平均出错率
+	Samples    int     // 样本数量
+}
+
+// NewTransferHistory 新建一个只保存在内存中的传输统计
+func NewTransferHistory() *TransferHistory {
+	return &TransferHistory{}
+}
+
+// LoadTransferHistory 从文件中加载传输统计，文件不存在或损坏时从空的统计开始
+func LoadTransferHistory(path string) *TransferHistory {
+	history := &TransferHistory{}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		json.Unmarshal(data, history)
+	}
+	history.path = path
+	return history
+}
+
+// Record 记录一次分片请求的结果
+func (h *TransferHistory) Record(sample SliceSample) {
+	if h == nil || (sample.Bytes <= 0 && !sample.Err) {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	errValue := 0.0
+	if sample.Err {
+		errValue = 1
+	}
+	h.ErrorRate += (errValue - h.ErrorRate) * adaptiveEwmaWeight
+	if !sample.Err && sample.Latency > 0 {
+		throughput := float64(sample.Bytes) / sample.Latency.Seconds()
+		if h.Throughput == 0 {
+			h.Throughput = throughput
+		} else {
+			h.Throughput += (throughput - h.Throughput) * adaptiveEwmaWeight
+		}
+	}
+	h.Samples++
+}
+
+// SliceBytes 根据统计选择分片大小，使单个分片大约传输AdaptiveSliceDuration，
+// 出错率高时减小分片，样本不够时返回defaultBytes
+func (h *TransferHistory) SliceBytes(defaultBytes int) int {
+	if h == nil {
+		return defaultBytes
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.Samples < adaptiveMinSamples || h.Throughput <= 0 {
+		return defaultBytes
+	}
+
+	size := h.Throughput * AdaptiveSliceDuration.Seconds()
+	if h.ErrorRate > adaptiveErrorRate {
+		size /= 2
+	}
+
+	// 取不超过估算值的2的幂
+	sliceBytes := AdaptiveMinSliceBytes
+	for sliceBytes*2 <= AdaptiveMaxSliceBytes && float64(sliceBytes*2) <= size {
+		sliceBytes *= 2
+	}
+	return sliceBytes
+}
+
+// Save 保存传输统计，先写临时文件再改名，写到一半中断或多个进程同时保存都不会损坏文件，
+// 没有指定保存路径时不做任何事
+func (h *TransferHistory) Save() error {
+	if h == nil || h.path == "" {
+		return nil
+	}
+
+	h.saveLock.Lock()
+	defer h.saveLock.Unlock()
+	h.lock.Lock()
+	data, err := json.Marshal(h)
+	h.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(h.path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(h.path), filepath.Base(h.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), h.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -5,21 +5,18 @@ import "time"
 // 定义常量
 const SmallFileSize 			= 1024*1024     // 小文件大小
 const SliceBytes 				= 1024*1024*1   // 分片大小
-const UploadRetryChannelNum 	= 100			// 上传的重试通道队列大小
-const DownloadRetryChannelNum 	= 100			// 下载的重试通道队列大小
-const UploadTimeout 			= 300			// 上传超时时间，单位秒
-const DownloadTimeout 			= 300			// 上传超时时间，单位秒
+const IdleTimeout 			= 300			// 重试时距上次传输有进展超过该时间则放弃，单位秒
 const UpGoroutineMaxNumPerFile  = 10			// 每个上传文件开启的goroutine最大数量
 const DpGoroutineMaxNumPerFile  = 10			// 每个下载文件开启的goroutine最大数量
-
-// 定义公共变量
-var BaseUrl string
+const GracePeriod 				= 10			// 取消传输后等待进行中分片完成的时间，单位秒
+const TransferMaxNum 			= 32			// 整个进程同时进行的分片请求最大数量
 
 // FileInfo 列出文件元信息
 type FileInfo struct {
 	Filename    string  // 文件名
 	Filesize    int64   // 文件大小
 	Filetype    string  // 文件类型（目前有普通文件和切片文件两种）
+	ModifyTime  time.Time  // 文件修改时间，老服务端没有返回时为零值
 }
 
 // ListFileInfos 文件列表结构
@@ -33,10 +30,53 @@ type FileMetadata struct {
 	Filesize        int64           // 文件大小（字节单位）
 	Filename        string          // 文件名称
 	SliceNum        int             // 切片数量
-	Md5sum          string          // 文件md5值
+	Md5sum          string          // 文件md5值，使用其他校验算法时为空
 	ModifyTime      time.Time       // 文件修改时间
+	SliceBytes      int             // 切片大小
+	HashAlgo        string          // 文件校验算法，为空时表示md5
+	Hashsum         string          // 文件校验值
+	SliceBitmap     []byte          // 直接写入模式下已下载完成的分片位图，为nil时分片保存在分片目录中
+}
+
+// FilePart 文件片
+type FilePart struct{
+	Fid         string  // 操作文件ID，随机生成的UUID
+	Index       int     // 文件切片序号
+	Data        []byte  // 分片数据
+	Checksum    string  // 分片数据的CRC32C校验值，为空时不校验
 }
 
 type SliceSeq struct {
 	Slices  []int   // 需要重传的分片号
-}
\ No newline at end of file
+}
+
+// 分片上传格式
+const SliceFormatJson       = "json"    // FilePart以json编码，分片数据会被base64编码
+const SliceFormatBinary     = "binary"  // 请求体为原始分片数据，文件ID和序号放在请求头中
+
+// 二进制分片上传使用的请求头
+const SliceFidHeader        = "X-Slice-Fid"     // 文件ID
+const SliceIndexHeader      = "X-Slice-Index"   // 分片序号
+const SliceChecksumHeader   = "X-Slice-Checksum" // 分片校验值，上传和下载分片时都会带上
+
+// 下载的目标文件已存在时的处理方式
+const OnExistOverwrite      = "overwrite"   // 覆盖已有文件
+const OnExistSkip           = "skip"        // 跳过下载，保留已有文件
+const OnExistRename         = "rename"      // 保存为带序号后缀的新文件名，如abc (1).pdf
+
+// Capabilities 服务端支持的功能，通过capabilities接口获取
+type Capabilities struct {
+	SliceFormats    []string    // 支持的分片上传格式
+	MaxUploadSize   int64       // 整个文件上传允许的最大文件大小，0表示不限制
+	HashAlgos       []string    // 支持的文件校验算法
+}
+
+// Supports 判断服务端是否支持某个功能取值
+func Supports(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Config 客户端配置，上传器和下载器通过它获取服务地址和传输参数，
+// 同一进程中可以用不同的Config同时访问多个服务端
+type Config struct {
+	BaseUrl           string           // 服务基础URL，如http://127.0.0.1:800/
+	HTTPClient        *http.Client     // 发起请求使用的http客户端
+	SliceBytes        int              // 分片大小
+	SmallFileSize     int64            // 小于等于该大小的文件整个上传
+	UpGoroutineMaxNum int              // 每个上传文件开启的goroutine最大数量
+	DpGoroutineMaxNum int              // 每个下载文件开启的goroutine最大数量
+	GracePeriod       time.Duration    // 传输被取消后，等待进行中的分片完成的最长时间
+	SliceFormat       string           // 分片上传格式，为空时根据服务端能力自动选择
+	HashAlgos         []string         // 文件校验算法，按优先级排列，上传时选用第一个服务端也支持的
+	DirectWrite       bool             // 切片下载时直接写入预分配的目标文件，不再生成分片文件
+	OnExist           string           // 下载的目标文件已存在时的处理方式，见OnExistOverwrite等
+	Scheduler         *Scheduler       // 全局传输调度器，为nil时只按每个文件的goroutine数量限制
+	Adaptive          bool             // 根据观测到的时延和出错率自动调整分片并发数和新上传文件的分片大小
+	History           *TransferHistory // 最近传输的观测统计，自适应时使用，由调用者在传输结束后Save
+	UploadRate        *RateLimiter     // 所有上传共享的限速，为nil时不限速
+	DownloadRate      *RateLimiter     // 所有下载共享的限速，为nil时不限速
+	UploadFileRate    *RateSchedule    // 每个上传文件各自的限速，为nil时不限速
+	DownloadFileRate  *RateSchedule    // 每个下载文件各自的限速，为nil时不限速
+	Retry             RetryPolicy      // 请求失败后的重试策略
+	Logger            *slog.Logger     // 日志，为nil时使用common.Logger()
+	Progress          ProgressFunc     // 传输进度回调，为nil时不统计进度
+	Token             string           // 访问凭据，不为空时每个请求都带上Authorization: Bearer请求头
+
+	capabilities *capabilitiesCache // 服务端能力缓存
+}
+
+// 服务端能力缓存，同一个Config只查询一次
+type capabilitiesCache struct {
+	lock sync.Mutex
+	caps *Capabilities
+}
+
+// NewConfig 使用默认参数新建一个配置，baseUrl以/结尾
+func NewConfig(baseUrl string) *Config {
+	return &Config{
+		BaseUrl:           baseUrl,
+		HTTPClient:        newHTTPClient(),
+		SliceBytes:        SliceBytes,
+		SmallFileSize:     SmallFileSize,
+		UpGoroutineMaxNum: UpGoroutineMaxNumPerFile,
+		DpGoroutineMaxNum: DpGoroutineMaxNumPerFile,
+		GracePeriod:       GracePeriod * time.Second,
+		HashAlgos:         HashAlgoNames(),
+		OnExist:           OnExistOverwrite,
+		Scheduler:         DefaultScheduler,
+		History:           NewTransferHistory(),
+		Retry:             DefaultRetryPolicy(),
+		capabilities:      &capabilitiesCache{},
+	}
+}
+
+// 新建默认的http客户端，空闲连接数与全局分片请求数一致，避免并发分片时频繁新建连接
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = TransferMaxNum
+	return &http.Client{Transport: transport}
+}
+
+// Log 获取配置使用的日志
+func (c *Config) Log() *slog.Logger {
+	if c.Logger == nil {
+		return Logger()
+	}
+	return c.Logger
+}
+
+// Url 拼接接口地址，参数经过转义，文件名中可以有空格、&、#等字符
+func (c *Config) Url(endpoint string, query url.Values) string {
+	if len(query) == 0 {
+		return c.BaseUrl + endpoint
+	}
+	return c.BaseUrl + endpoint + "?" + query.Encode()
+}
+
+// Do 使用配置的http客户端发起请求
+func (c *Config) Do(req *http.Request) (*http.Response, error) {
+	if c.Token != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// 不支持capabilities接口的老服务端只支持json格式的分片和md5校验，整个上传也只按默认的小文件大小来
+var legacyCapabilities = Capabilities{
+	SliceFormats:  []string{SliceFormatJson},
+	MaxUploadSize: SmallFileSize,
+	HashAlgos:     []string{HashMd5},
+}
+
+// Capabilities 获取服务端支持的功能，老服务端或查询失败时返回只支持json分片的默认值
+func (c *Config) Capabilities(ctx context.Context) *Capabilities {
+	if c.capabilities != nil {
+		c.capabilities.lock.Lock()
+		defer c.capabilities.lock.Unlock()
+		if c.capabilities.caps != nil {
+			return c.capabilities.caps
+		}
+	}
+
+	caps, cacheable := c.fetchCapabilities(ctx)
+	if c.capabilities != nil && cacheable {
+		c.capabilities.caps = caps
+	}
+	return caps
+}
+
+// 向服务端查询支持的功能，网络错误时结果不缓存，下次再重新查询
+func (c *Config) fetchCapabilities(ctx context.Context) (*Capabilities, bool) {
+	legacy := legacyCapabilities
+	req, err := http.NewRequestWithContext(ctx, "GET", c.Url("capabilities", nil), nil)
+	if err != nil {
+		return &legacy, false
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return &legacy, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &legacy, true
+	}
+
+	var caps Capabilities
+	err = json.NewDecoder(resp.Body).Decode(&caps)
+	if err != nil {
+		return &legacy, true
+	}
+	return &caps, true
+}
+
+// UploadSliceFormat 获取分片上传格式，没有指定时服务端支持二进制格式就使用二进制格式
+func (c *Config) UploadSliceFormat(ctx context.Context) string {
+	if c.SliceFormat != "" {
+		return c.SliceFormat
+	}
+	if Supports(c.Capabilities(ctx).SliceFormats, SliceFormatBinary) {
+		return SliceFormatBinary
+	}
+	return SliceFormatJson
+}
+
+// SingleUploadLimit 获取整个文件上传的大小上限，取配置的SmallFileSize与服务端允许的最大值中较小的一个
+func (c *Config) SingleUploadLimit(ctx context.Context) int64 {
+	limit := c.SmallFileSize
+	maxSize := c.Capabilities(ctx).MaxUploadSize
+	if maxSize > 0 && limit > maxSize {
+		limit = maxSize
+	}
+	return limit
+}
+
+// NewConcurrency 按配置新建单个文件的分片并发控制，limit为初始并发数
+func (c *Config) NewConcurrency(limit int) *Concurrency {
+	return NewConcurrency(limit, AdaptiveMaxNumPerFile, c.Adaptive, c.History)
+}
+
+// UploadSliceBytes 新上传文件使用的分片大小，开启自适应时根据最近的传输统计选择
+func (c *Config) UploadSliceBytes() int {
+	if c.Adaptive {
+		return c.History.SliceBytes(c.SliceBytes)
+	}
+	return c.SliceBytes
+}
+
+// NegotiateHashAlgo 协商文件校验算法，选用配置中第一个服务端也支持的算法，都不支持时使用md5
+func (c *Config) NegotiateHashAlgo(ctx context.Context) HashAlgo {
+	serverAlgos := c.Capabilities(ctx).HashAlgos
+	for _, name := range c.HashAlgos {
+		if !Supports(serverAlgos, name) {
+			continue
+		}
+		algo, err := GetHashAlgo(name)
+		if err == nil {
+			return algo
+		}
+	}
+
+	algo, _ := GetHashAlgo(HashMd5)
+	return algo
+}
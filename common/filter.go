@@ -0,0 +1,233 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Filter 按gitignore风格的规则和文件大小、修改时间筛选要传输的文件，为nil时所有文件都通过。
+// 规则按添加的顺序匹配，最后一条匹配的规则决定文件是否被排除：
+//   - 不含/的模式匹配任意一级的文件名或目录名，如*.tmp
+//   - 以/开头或中间含有/的模式从根目录开始匹配整个相对路径，如/build/*.o
+//   - 以/结尾的模式只匹配目录及其中的所有文件，如.git/，目录被排除后其中的文件都被排除，不能再单独包含
+//   - **匹配任意多级目录，如logs/**/*.gz
+//   - 以re:开头的模式是匹配整个相对路径的正则表达式，如re:\.(tmp|bak)$
+//
+// 包含规则与.gitignore中以!开头的规则相同，只用来重新包含之前被排除的文件，没有匹配任何规则的文件都通过。
+// 只传输部分文件时先排除所有文件再包含，如Exclude("*")之后Include("reports/")
+type Filter struct {
+	MinSize   int64     // 文件大小下限，0表示不限制
+	MaxSize   int64     // 文件大小上限，0表示不限制
+	NewerThan time.Time // 只通过在此之后修改的文件，零值表示不限制
+	OlderThan time.Time // 只通过在此之前修改的文件，零值表示不限制
+
+	rules []filterRule
+}
+
+// 一条包含或排除规则
+type filterRule struct {
+	include  bool           // 是否是包含规则
+	dirOnly  bool           // 是否只匹配目录
+	anchored bool           // 是否从根目录开始匹配整个相对路径，否则只匹配最后一级
+	segments []string       // 按/分隔的glob模式
+	re       *regexp.Regexp // 正则表达式规则
+}
+
+// 解析一条规则的模式
+func parseFilterRule(pattern string, include bool) (filterRule, error) {
+	rule := filterRule{include: include}
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return rule, err
+		}
+		rule.re = re
+		return rule, nil
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if strings.HasPrefix(pattern, "/") {
+		rule.anchored = true
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+	if pattern == "" {
+		return rule, errors.New("empty filter rule")
+	}
+	if strings.Contains(pattern, "/") {
+		rule.anchored = true
+	}
+
+	rule.segments = strings.Split(pattern, "/")
+	for _, segment := range rule.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return rule, errors.New("invalid filter rule: " + pattern)
+		}
+	}
+	return rule, nil
+}
+
+// 判断规则是否匹配以/分隔的相对路径，只匹配目录的规则匹配路径本身或任何一级上级目录
+func (r *filterRule) match(relPath string, isDir bool) bool {
+	if !r.dirOnly {
+		return r.matchPath(relPath)
+	}
+	elems := strings.Split(relPath, "/")
+	n := len(elems)
+	if !isDir {
+		n--
+	}
+	for i := n; i > 0; i-- {
+		if r.matchPath(strings.Join(elems[:i], "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// 判断规则的模式是否匹配相对路径本身
+func (r *filterRule) matchPath(relPath string) bool {
+	if r.re != nil {
+		return r.re.MatchString(relPath)
+	}
+	if r.anchored {
+		return matchSegments(r.segments, strings.Split(relPath, "/"))
+	}
+	return matchSegments(r.segments, []string{path.Base(relPath)})
+}
+
+// 按级匹配路径，**匹配任意多级
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], name[0])
+	return ok && matchSegments(pattern[1:], name[1:])
+}
+
+// 添加一条规则
+func (f *Filter) addRule(pattern string, include bool) error {
+	rule, err := parseFilterRule(pattern, include)
+	if err != nil {
+		return err
+	}
+	f.rules = append(f.rules, rule)
+	return nil
+}
+
+// MatchPath 按级匹配以/分隔的相对路径，每一级按path.Match匹配，*不跨越/，**匹配任意多级
+func MatchPath(pattern string, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// HasMeta 判断名称中是否有glob的特殊字符，有则作为模式匹配，\用来转义
+func HasMeta(name string) bool {
+	return strings.ContainsAny(name, `*?[\`)
+}
+
+// Include 添加一条包含规则，重新包含之前的规则排除的文件
+func (f *Filter) Include(pattern string) error {
+	return f.addRule(pattern, true)
+}
+
+// Exclude 添加一条排除规则
+func (f *Filter) Exclude(pattern string) error {
+	return f.addRule(pattern, false)
+}
+
+// ReadRules 按.gitignore的格式读取排除规则，每行一条，忽略空行和#开头的注释行，
+// 以!开头的是包含规则，行首的\#和\!表示字面的#和!
+func (f *Filter) ReadRules(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(line, "!"):
+			err = f.Include(line[1:])
+		case strings.HasPrefix(line, `\#`), strings.HasPrefix(line, `\!`):
+			err = f.Exclude(line[1:])
+		default:
+			err = f.Exclude(line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Empty 是否没有任何过滤条件
+func (f *Filter) Empty() bool {
+	return f == nil || (len(f.rules) == 0 && f.MinSize == 0 && f.MaxSize == 0 &&
+		f.NewerThan.IsZero() && f.OlderThan.IsZero())
+}
+
+// 最后一条匹配的规则是否是包含规则，matched表示是否有规则匹配
+func (f *Filter) ruleResult(relPath string, isDir bool) (include bool, matched bool) {
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		if f.rules[i].match(relPath, isDir) {
+			return f.rules[i].include, true
+		}
+	}
+	return false, false
+}
+
+// Excluded 按规则判断以/分隔的相对路径是否被排除，任何一级上级目录被排除时也被排除。
+// 遍历目录时可以用它跳过被排除的目录
+func (f *Filter) Excluded(relPath string, isDir bool) bool {
+	if f == nil || len(f.rules) == 0 {
+		return false
+	}
+
+	elems := strings.Split(relPath, "/")
+	for i := 1; i < len(elems); i++ {
+		if include, matched := f.ruleResult(strings.Join(elems[:i], "/"), true); matched && !include {
+			return true
+		}
+	}
+	include, matched := f.ruleResult(relPath, isDir)
+	return matched && !include
+}
+
+// Match 判断文件是否通过所有过滤条件，不知道修改时间时传零值，不按时间过滤
+func (f *Filter) Match(relPath string, size int64, modTime time.Time) bool {
+	if f == nil {
+		return true
+	}
+	if f.Excluded(relPath, false) {
+		return false
+	}
+	if (f.MinSize > 0 && size < f.MinSize) || (f.MaxSize > 0 && size > f.MaxSize) {
+		return false
+	}
+	if !modTime.IsZero() {
+		if (!f.NewerThan.IsZero() && !modTime.After(f.NewerThan)) ||
+			(!f.OlderThan.IsZero() && !modTime.Before(f.OlderThan)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 按顺序添加规则，以!开头的是包含规则
+func newTestFilter(t *testing.T, rules ...string) *Filter {
+	f := &Filter{}
+	for _, rule := range rules {
+		var err error
+		if strings.HasPrefix(rule, "!") {
+			err = f.Include(rule[1:])
+		} else {
+			err = f.Exclude(rule)
+		}
+		if err != nil {
+			t.Fatalf("rule %q: %v", rule, err)
+		}
+	}
+	return f
+}
+
+func TestFilterRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		path  string
+		isDir bool
+		pass  bool
+	}{
+		{"no rules", nil, "a/b.go", false, true},
+		{"basename glob", []string{"*.tmp"}, "a/b/c.tmp", false, false},
+		{"basename glob other file", []string{"*.tmp"}, "a/b/c.go", false, true},
+		{"anchored", []string{"/build/*.o"}, "build/x.o", false, false},
+		{"anchored not nested", []string{"/build/*.o"}, "src/build/x.o", false, true},
+		{"pattern with slash is anchored", []string{"build/*.o"}, "src/build/x.o", false, true},
+		{"double star", []string{"logs/**/*.gz"}, "logs/2026/01/a.gz", false, false},
+		{"double star zero dirs", []string{"logs/**/*.gz"}, "logs/a.gz", false, false},
+		{"regexp", []string{`re:\.(tmp|bak)$`}, "a/b.bak", false, false},
+		{"dir rule excludes dir", []string{".git/"}, ".git", true, false},
+		{"dir rule excludes contents", []string{".git/"}, ".git/objects/ab", false, false},
+		{"dir rule excludes nested contents", []string{".git/"}, "sub/.git/config", false, false},
+		{"dir rule skips file of same name", []string{"build/"}, "build", false, true},
+		{"parent excluded by name", []string{"node_modules"}, "web/node_modules/x/index.js", false, false},
+
+		// 包含规则只重新包含被排除的文件，不会把过滤变成白名单
+		{"include alone keeps others", []string{"!*.go"}, "README.md", false, true},
+		{"include alone keeps match", []string{"!*.go"}, "main.go", false, true},
+		{"dir include alone keeps others", []string{"!reports/"}, "other.txt", false, true},
+		{"re-include after exclude", []string{"*.log", "!important.log"}, "important.log", false, true},
+		{"re-include keeps unrelated", []string{"*.log", "!important.log"}, "x.go", false, true},
+		{"re-include only named", []string{"*.log", "!important.log"}, "debug.log", false, false},
+		{"later exclude wins", []string{"!important.log", "*.log"}, "important.log", false, false},
+
+		// 先排除所有文件再包含目录，目录中的文件都通过
+		{"dir include matches contents", []string{"*", "!reports/"}, "reports/x.pdf", false, true},
+		{"dir include matches nested", []string{"*", "!reports/"}, "reports/2026/x.pdf", false, true},
+		{"dir include matches dir", []string{"*", "!reports/"}, "reports", true, true},
+		{"dir include leaves others excluded", []string{"*", "!reports/"}, "notes.txt", false, false},
+
+		// 与.gitignore相同，目录被排除后不能再单独包含其中的文件
+		{"excluded parent wins", []string{"build/", "!build/keep.txt"}, "build/keep.txt", false, false},
+		{"excluded parent by name wins", []string{"tmp", "!tmp/keep.txt"}, "tmp/keep.txt", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFilter(t, tt.rules...)
+			if got := !f.Excluded(tt.path, tt.isDir); got != tt.pass {
+				t.Errorf("rules %q: Excluded(%q, %v) = %v, want %v", tt.rules, tt.path, tt.isDir, !got, !tt.pass)
+			}
+			if !tt.isDir {
+				if got := f.Match(tt.path, 1, time.Time{}); got != tt.pass {
+					t.Errorf("rules %q: Match(%q) = %v, want %v", tt.rules, tt.path, got, tt.pass)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterReadRules(t *testing.T) {
+	f := &Filter{}
+	rules := "# comment\n\n*.log\n!important.log\n\\#notes\n\\!bang\ncore.*   \n"
+	err := f.ReadRules(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		pass bool
+	}{
+		{"a.log", false},
+		{"important.log", true},
+		{"#notes", false},
+		{"!bang", false},
+		{"core.1234", false},
+		{"# comment", true},
+		{"main.go", true},
+	}
+	for _, tt := range tests {
+		if got := f.Match(tt.path, 1, time.Time{}); got != tt.pass {
+			t.Errorf("Match(%q) = %v, want %v", tt.path, got, tt.pass)
+		}
+	}
+}
+
+func TestFilterInvalidRules(t *testing.T) {
+	for _, rule := range []string{"", "/", "[a", "re:("} {
+		if err := (&Filter{}).Exclude(rule); err == nil {
+			t.Errorf("Exclude(%q) = nil, want error", rule)
+		}
+	}
+}
+
+func TestFilterSizeAndTime(t *testing.T) {
+	now := time.Now()
+	f := &Filter{
+		MinSize:   10,
+		MaxSize:   100,
+		NewerThan: now.Add(-time.Hour),
+		OlderThan: now,
+	}
+	tests := []struct {
+		name    string
+		size    int64
+		modTime time.Time
+		pass    bool
+	}{
+		{"in range", 50, now.Add(-time.Minute), true},
+		{"too small", 9, now.Add(-time.Minute), false},
+		{"too large", 101, now.Add(-time.Minute), false},
+		{"too old", 50, now.Add(-2 * time.Hour), false},
+		{"too new", 50, now.Add(time.Minute), false},
+		{"unknown time", 50, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		if got := f.Match("a.bin", tt.size, tt.modTime); got != tt.pass {
+			t.Errorf("%s: Match = %v, want %v", tt.name, got, tt.pass)
+		}
+	}
+	if !(*Filter)(nil).Match("a.bin", 0, now) {
+		t.Error("nil filter rejected a file")
+	}
+}
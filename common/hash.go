@@ -0,0 +1,108 @@
+package common
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"lukechampine.com/blake3"
+	"sort"
+	"sync"
+)
+
+// 支持的文件校验算法
+const HashMd5 = "md5" // 老版本只支持md5
+const HashSha256 = "sha256"
+const HashBlake3 = "blake3"
+
+// HashAlgo 文件校验使用的哈希算法
+type HashAlgo interface {
+	Name() string   // 算法名称，在协议和元数据中使用
+	New() hash.Hash // 新建一个哈希计算器
+}
+
+// 以构造函数实现的哈希算法
+type hashAlgo struct {
+	name    string
+	newFunc func() hash.Hash
+}
+
+func (h *hashAlgo) Name() string {
+	return h.name
+}
+
+func (h *hashAlgo) New() hash.Hash {
+	return h.newFunc()
+}
+
+// 已注册的哈希算法
+var hashAlgos = struct {
+	lock  sync.RWMutex
+	algos map[string]HashAlgo
+}{
+	algos: map[string]HashAlgo{
+		HashMd5:    &hashAlgo{name: HashMd5, newFunc: md5.New},
+		HashSha256: &hashAlgo{name: HashSha256, newFunc: sha256.New},
+		HashBlake3: &hashAlgo{name: HashBlake3, newFunc: func() hash.Hash { return blake3.New(32, nil) }},
+	},
+}
+
+// RegisterHashAlgo 注册一个哈希算法，同名算法会被覆盖
+func RegisterHashAlgo(algo HashAlgo) {
+	hashAlgos.lock.Lock()
+	defer hashAlgos.lock.Unlock()
+	hashAlgos.algos[algo.Name()] = algo
+}
+
+// GetHashAlgo 根据名称获取哈希算法，名称为空时是老版本的元数据，使用md5
+func GetHashAlgo(name string) (HashAlgo, error) {
+	if name == "" {
+		name = HashMd5
+	}
+
+	hashAlgos.lock.RLock()
+	defer hashAlgos.lock.RUnlock()
+	algo, ok := hashAlgos.algos[name]
+	if !ok {
+		return nil, errors.New("unsupported hash algorithm: " + name)
+	}
+	return algo, nil
+}
+
+// HashAlgoNames 获取已注册的哈希算法名称
+func HashAlgoNames() []string {
+	hashAlgos.lock.RLock()
+	defer hashAlgos.lock.RUnlock()
+
+	names := []string{}
+	for _, name := range []string{HashBlake3, HashSha256, HashMd5} {
+		if _, ok := hashAlgos.algos[name]; ok {
+			names = append(names, name)
+		}
+	}
+	others := []string{}
+	for name := range hashAlgos.algos {
+		if !Supports(names, name) {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// Digest 返回文件校验使用的算法和校验值，老版本的元数据只有md5值
+func (m *FileMetadata) Digest() (string, string) {
+	if m.HashAlgo == "" || (m.HashAlgo == HashMd5 && m.Hashsum == "") {
+		return HashMd5, m.Md5sum
+	}
+	return m.HashAlgo, m.Hashsum
+}
+
+// SetDigest 设置文件校验值，md5会同时写入Md5sum，兼容只认识Md5sum的老服务端
+func (m *FileMetadata) SetDigest(algo string, sum string) {
+	m.HashAlgo = algo
+	m.Hashsum = sum
+	if algo == HashMd5 {
+		m.Md5sum = sum
+	}
+}
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// 日志语言
+const (
+	LangEnglish = "en"
+	LangChinese = "zh"
+)
+
+// 日志格式
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
+)
+
+var defaultLogger atomic.Pointer[slog.Logger]
+
+func init() {
+	defaultLogger.Store(slog.New(NewCatalogHandler(slog.NewTextHandler(os.Stderr, nil), DetectLanguage())))
+}
+
+// Logger 获取默认日志，没有指定Logger的Config和服务端都使用它
+func Logger() *slog.Logger {
+	return defaultLogger.Load()
+}
+
+// SetLogger 设置默认日志
+func SetLogger(logger *slog.Logger) {
+	defaultLogger.Store(logger)
+}
+
+// NewLogger 新建一个输出到w的日志，format为text或json，消息按lang翻译
+func NewLogger(w io.Writer, format string, level slog.Leveler, lang string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format {
+	case LogFormatText:
+		handler = slog.NewTextHandler(w, opts)
+	case LogFormatJson:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, errors.New("unknown log format: " + format)
+	}
+	return slog.New(NewCatalogHandler(handler, lang)), nil
+}
+
+// ParseLogLevel 解析日志级别，可以是debug、info、warn、error
+func ParseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// DetectLanguage 根据LC_ALL、LC_MESSAGES、LANG环境变量选择日志语言，默认英文
+func DetectLanguage() string {
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(value), LangChinese) {
+			return LangChinese
+		}
+		return LangEnglish
+	}
+	return LangEnglish
+}
+
+// Translate 把消息ID翻译成lang对应的消息，lang的消息目录中没有时使用英文，都没有时返回消息ID
+func Translate(lang string, id string) string {
+	if msg, ok := catalogs[lang][id]; ok {
+		return msg
+	}
+	if msg, ok := catalogs[LangEnglish][id]; ok {
+		return msg
+	}
+	return id
+}
+
+// catalogHandler 把日志消息ID翻译成指定语言后交给下一个Handler
+type catalogHandler struct {
+	next slog.Handler
+	lang string
+}
+
+// NewCatalogHandler 包装一个Handler，日志消息按消息ID翻译成lang对应的消息，见Translate
+func NewCatalogHandler(next slog.Handler, lang string) slog.Handler {
+	return &catalogHandler{next: next, lang: lang}
+}
+
+func (h *catalogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *catalogHandler) Handle(ctx context.Context, record slog.Record) error {
+	record.Message = Translate(h.lang, record.Message)
+	return h.next.Handle(ctx, record)
+}
+
+func (h *catalogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &catalogHandler{next: h.next.WithAttrs(attrs), lang: h.lang}
+}
+
+func (h *catalogHandler) WithGroup(name string) slog.Handler {
+	return &catalogHandler{next: h.next.WithGroup(name), lang: h.lang}
+}
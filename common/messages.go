@@ -0,0 +1,215 @@
+package common
+
+// 日志和命令行输出的消息目录，键为消息ID，新增消息时各语言都要补上
+var catalogs = map[string]map[string]string{
+	LangEnglish: {
+		"cli.config_failed":              "Failed to load config file",
+		"cli.elapsed":                    "Finished",
+		"cli.error":                      "error",
+		"cli.expand_failed":              "failed to expand files to transfer",
+		"cli.filtered":                   "skipped by filter",
+		"cli.history_save_failed":        "Failed to save transfer history",
+		"cli.invalid_flag":               "Invalid command line argument",
+		"cli.list_name":                  "name",
+		"cli.list_size":                  "size",
+		"cli.no_files":                   "failed to get files to transfer",
+		"cli.progress_retries":           "retries",
+		"cli.progress_slices":            "slices",
+		"cli.progress_total":             "total",
+		"cli.reason":                     "reason",
+		"cli.signal":                     "Signal received, no new slices will be started; waiting for in-flight slices. Interrupt again to exit immediately",
+		"cli.signal_again":               "Second signal received, exiting immediately",
+		"cli.skip_state_file":            "transfer state file of an unfinished upload or download",
+		"cli.summary":                    "%d files, %d failed",
+		"client.delete_failed":           "Failed to delete file",
+		"client.list_failed":             "Failed to list files",
+		"client.stat_failed":             "Failed to get file info",
+		"download.cancelled":             "Download cancelled or timed out, progress saved; run again to resume",
+		"download.check_failed":          "Failed to check file on server",
+		"download.create_failed":         "Failed to create temporary file",
+		"download.dir_not_exist":         "Download directory does not exist",
+		"download.done":                  "Download finished",
+		"download.failed":                "Download failed",
+		"download.failed_saved":          "Download failed, progress saved",
+		"download.hash_mismatch":         "File checksum mismatch, please download again",
+		"download.interrupted":           "Download interrupted, progress saved",
+		"download.kept_existing":         "Target already exists, keeping existing file",
+		"download.merge":                 "Merging slices",
+		"download.merge_failed":          "Failed to merge slice",
+		"download.metainfo_failed":       "Failed to get file metadata",
+		"download.mkdir_failed":          "Failed to create slice directory",
+		"download.new":                   "Starting a new download",
+		"download.open_part_failed":      "Failed to open temporary download file",
+		"download.part_stale":            "Partial download is stale, restarting download",
+		"download.preallocate_failed":    "Failed to preallocate download file",
+		"download.range_mismatch":        "Server resumed from the wrong offset, restarting download",
+		"download.read_slice_failed":     "Failed to read slice file",
+		"download.remote_gone":           "File no longer exists on server",
+		"download.request_failed":        "Download request failed",
+		"download.resume":                "Resuming download",
+		"download.resume_at":             "Resuming download",
+		"download.resume_save_failed":    "Failed to save resume info, an interrupted download will start over",
+		"download.retry":                 "Download failed, retrying",
+		"download.save_failed":           "Failed to move downloaded file into place",
+		"download.skipped":               "Target already exists, skipping download",
+		"download.unfinished":            "Found unfinished download",
+		"download.unknown_type":          "Unknown file type, cannot download",
+		"download.unsafe_name":           "rejected unsafe name",
+		"file.stat_failed":               "Failed to stat file",
+		"hash.unsupported":               "Unsupported hash algorithm",
+		"meta.decode_failed":             "Failed to decode metadata file, discarding it",
+		"meta.open_failed":               "Failed to open metadata file, discarding it",
+		"meta.store_failed":              "Failed to write metadata file",
+		"server.deleted":                 "File deleted",
+		"server.hash_mismatch":           "File checksum mismatch",
+		"server.merged":                  "Slices merged",
+		"server.mkdir_failed":            "Failed to create storage directory",
+		"server.save_failed":             "Failed to save file",
+		"server.slice_checksum_mismatch": "Slice checksum mismatch",
+		"server.slice_save_failed":       "Failed to save slice",
+		"server.slice_send_failed":       "Failed to send slice",
+		"server.slice_upload_start":      "Sliced upload started",
+		"server.start":                   "Server started",
+		"server.start_failed":            "Failed to start server",
+		"server.stopped":                 "Server exited unexpectedly",
+		"server.uploaded":                "File uploaded",
+		"server.write_failed":            "Failed to write response",
+		"slice.all_done":                 "All slices transferred",
+		"slice.bad_file":                 "Ignoring unexpected file in slice directory",
+		"slice.download_failed":          "Slice download failed",
+		"slice.downloaded":               "Slice downloaded",
+		"slice.give_up":                  "Giving up on slice",
+		"slice.not_downloaded":           "Slice has not been downloaded",
+		"slice.retry":                    "Retrying slice",
+		"slice.upload":                   "Uploading slice",
+		"slice.upload_failed":            "Slice upload failed",
+		"slice.wait":                     "Waiting for slices to finish",
+		"slice.write_failed":             "Failed to write slice",
+		"upload.body_failed":             "Failed to build upload request",
+		"upload.command_failed":          "Request to server failed",
+		"upload.create_failed":           "Failed to create uploader",
+		"upload.done":                    "Upload finished",
+		"upload.empty_file":              "Empty files cannot be uploaded",
+		"upload.failed":                  "Upload failed",
+		"upload.failed_saved":            "Upload failed, progress saved",
+		"upload.file_modified":           "File changed since the last attempt, uploading from scratch",
+		"upload.interrupted":             "Upload cancelled or timed out, progress saved; run again to resume",
+		"upload.merge_failed":            "Failed to merge slices, please upload again",
+		"upload.new":                     "Starting a new upload",
+		"upload.not_exist":               "File to upload does not exist",
+		"upload.open_failed":             "Failed to open file for upload",
+		"upload.read_failed":             "Failed to read file",
+		"upload.resume":                  "Resuming upload",
+		"upload.retry":                   "Upload failed, retrying",
+		"upload.server_lost":             "Server has no record of the upload, starting over",
+		"upload.skipped":                 "Skipping upload",
+		"upload.start_failed":            "Failed to start sliced upload",
+		"upload.stat_failed":             "Failed to get slices still needed by the server",
+		"upload.uuid_failed":             "Failed to generate file ID",
+	},
+	LangChinese: {
+		"cli.config_failed":              "读取配置文件失败",
+		"cli.elapsed":                    "程序运行结束",
+		"cli.error":                      "错误",
+		"cli.expand_failed":              "展开要传输的文件失败",
+		"cli.filtered":                   "被过滤条件排除",
+		"cli.history_save_failed":        "保存传输统计失败",
+		"cli.invalid_flag":               "参数错误",
+		"cli.list_name":                  "文件名",
+		"cli.list_size":                  "文件大小",
+		"cli.no_files":                   "获取要传输的文件失败",
+		"cli.progress_retries":           "重试",
+		"cli.progress_slices":            "分片",
+		"cli.progress_total":             "合计",
+		"cli.reason":                     "原因",
+		"cli.signal":                     "收到退出信号，不再传输新的分片，等待进行中的分片完成后退出，再次中断将立即退出",
+		"cli.signal_again":               "再次收到退出信号，立即退出",
+		"cli.skip_state_file":            "未完成的上传或下载的断点续传状态文件",
+		"cli.summary":                    "共%d个文件，失败%d个",
+		"client.delete_failed":           "删除文件失败",
+		"client.list_failed":             "获取文件列表信息失败",
+		"client.stat_failed":             "获取文件基本信息失败",
+		"download.cancelled":             "下载被取消或超时，已保存下载进度，请重试",
+		"download.check_failed":          "检查服务端文件失败",
+		"download.create_failed":         "创建临时文件失败",
+		"download.dir_not_exist":         "指定的下载路径不存在",
+		"download.done":                  "文件下载成功",
+		"download.failed":                "文件下载失败",
+		"download.failed_saved":          "下载失败，已保存下载进度",
+		"download.hash_mismatch":         "文件校验失败，请重新下载",
+		"download.interrupted":           "下载中断，已保存下载进度",
+		"download.kept_existing":         "目标文件已存在，保留已有文件",
+		"download.merge":                 "开始合并文件",
+		"download.merge_failed":          "合并分片失败",
+		"download.metainfo_failed":       "获取文件元数据失败",
+		"download.mkdir_failed":          "创建下载分片目录失败",
+		"download.new":                   "这是一个全新要下载的文件",
+		"download.open_part_failed":      "打开临时下载文件失败",
+		"download.part_stale":            "临时下载文件已失效，重新下载",
+		"download.preallocate_failed":    "预分配下载文件失败",
+		"download.range_mismatch":        "续传位置不对，重新下载",
+		"download.read_slice_failed":     "读取分片文件失败",
+		"download.remote_gone":           "该文件在服务端已不存在",
+		"download.request_failed":        "文件下载请求失败",
+		"download.resume":                "继续下载，还需下载的分片",
+		"download.resume_at":             "从断点处续传",
+		"download.resume_save_failed":    "保存续传信息失败，下载中断后将重新下载",
+		"download.retry":                 "下载失败，稍后重试",
+		"download.save_failed":           "保存下载文件失败",
+		"download.skipped":               "目标文件已存在，跳过下载",
+		"download.unfinished":            "发现还没下载完的文件",
+		"download.unknown_type":          "未知的文件类型，下载失败",
+		"download.unsafe_name":           "拒绝不安全的名称",
+		"file.stat_failed":               "读取文件状态失败",
+		"hash.unsupported":               "不支持的校验算法",
+		"meta.decode_failed":             "解析元数据文件失败，已删除",
+		"meta.open_failed":               "打开元数据文件失败，已删除",
+		"meta.store_failed":              "写元数据文件失败",
+		"server.deleted":                 "删除文件成功",
+		"server.hash_mismatch":           "文件校验失败",
+		"server.merged":                  "文件合并成功",
+		"server.mkdir_failed":            "创建存储目录失败",
+		"server.save_failed":             "保存文件失败",
+		"server.slice_checksum_mismatch": "分片校验失败",
+		"server.slice_save_failed":       "保存分片失败",
+		"server.slice_send_failed":       "发送文件分片失败",
+		"server.slice_upload_start":      "开始切片上传文件",
+		"server.start":                   "服务启动",
+		"server.start_failed":            "启动服务失败",
+		"server.stopped":                 "服务异常退出",
+		"server.uploaded":                "上传文件成功",
+		"server.write_failed":            "返回数据失败",
+		"slice.all_done":                 "分片都已传输完成",
+		"slice.bad_file":                 "忽略分片目录中的无效文件",
+		"slice.download_failed":          "下载文件分片失败",
+		"slice.downloaded":               "文件分片下载成功",
+		"slice.give_up":                  "分片不再重试",
+		"slice.not_downloaded":           "分片还未下载完成",
+		"slice.retry":                    "重传文件分片",
+		"slice.upload":                   "上传文件分片",
+		"slice.upload_failed":            "上传文件分片失败",
+		"slice.wait":                     "等待分片传输完成",
+		"slice.write_failed":             "写入文件分片失败",
+		"upload.body_failed":             "构造上传请求失败",
+		"upload.command_failed":          "向服务端发送请求失败",
+		"upload.create_failed":           "创建上传器失败，上传文件失败",
+		"upload.done":                    "文件上传成功",
+		"upload.empty_file":              "空文件不能上传",
+		"upload.failed":                  "文件上传失败",
+		"upload.failed_saved":            "上传失败，已保存上传进度",
+		"upload.file_modified":           "该文件已被修改过，全量重新上传",
+		"upload.interrupted":             "上传被取消或超时，已保存上传进度，请重试",
+		"upload.merge_failed":            "合并文件失败，请重新上传",
+		"upload.new":                     "这是一个全新要上传的文件",
+		"upload.not_exist":               "要上传的文件不存在",
+		"upload.open_failed":             "打开要上传的文件失败",
+		"upload.read_failed":             "读取文件失败",
+		"upload.resume":                  "继续上传，还需上传的文件片",
+		"upload.retry":                   "上传失败，稍后重试",
+		"upload.server_lost":             "服务端没有这次上传的记录，重新开始上传",
+		"upload.skipped":                 "跳过上传",
+		"upload.start_failed":            "开始切片上传失败",
+		"upload.stat_failed":             "获取重传序号失败",
+		"upload.uuid_failed":             "生成UUID失败",
+	},
+}
@@ -0,0 +1,219 @@
+package common
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// ProgressInterval 两次进度事件之间的最短间隔，开始和结束的事件不受限制
+const ProgressInterval = 200 * time.Millisecond
+
+// Progress 一个文件的传输进度
+type Progress struct {
+	Action      string        // upload或download
+	Filename    string        // 文件名
+	Fid         string        // 文件ID，整个传输的文件没有
+	TotalBytes  int64         // 文件大小，事先不知道时为0
+	DoneBytes   int64         // 已完成的字节数，包括之前已传输的部分
+	TotalSlices int           // 分片总数，整个传输的文件为0
+	DoneSlices  int           // 已完成的分片数，包括之前已传输的分片
+	Retries     int           // 这次传输的重试次数
+	Rate        float64       // 这次传输的平均速度，字节每秒
+	ETA         time.Duration // 预计剩余时间，无法估计时为0
+	Elapsed     time.Duration // 这次传输已用的时间
+	Finished    bool          // 传输是否已结束
+	Err         error         // 传输结束时的错误，成功时为nil
+}
+
+// Percent 完成的百分比，不知道文件大小时返回-1
+func (p Progress) Percent() float64 {
+	if p.TotalBytes <= 0 {
+		if p.Finished && p.Err == nil {
+			return 100
+		}
+		return -1
+	}
+	return float64(p.DoneBytes) * 100 / float64(p.TotalBytes)
+}
+
+// ProgressFunc 接收进度事件的回调，同一个文件的事件按顺序调用，不同文件的事件可能并发调用，
+// 回调中不应做耗时的操作
+type ProgressFunc func(Progress)
+
+// ProgressChannel 把进度事件发送到ch中，ch满时丢弃中间的事件，结束事件会等待ch有空位
+func ProgressChannel(ch chan<- Progress) ProgressFunc {
+	return func(p Progress) {
+		if p.Finished {
+			ch <- p
+			return
+		}
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// ProgressReporter 统计一个文件的传输进度，并按ProgressInterval限频调用回调，为nil时不做任何事
+type ProgressReporter struct {
+	lock        sync.Mutex
+	fn          ProgressFunc
+	progress    Progress
+	start       time.Time
+	transferred int64     // 这次传输实际传输的字节数，用于计算速度
+	lastEmit    time.Time // 上次发出事件的时间
+}
+
+// NewProgressReporter 新建一个进度统计，fn为nil时返回nil，会立即发出一个开始事件
+func NewProgressReporter(fn ProgressFunc, action string, filename string, fid string, totalBytes int64, totalSlices int) *ProgressReporter {
+	if fn == nil {
+		return nil
+	}
+
+	r := &ProgressReporter{
+		fn:    fn,
+		start: time.Now(),
+		progress: Progress{
+			Action:      action,
+			Filename:    filename,
+			Fid:         fid,
+			TotalBytes:  totalBytes,
+			TotalSlices: totalSlices,
+		},
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.emit(true)
+	return r
+}
+
+// Skip 记录之前已经传输过的分片，续传时使用，不计入速度
+func (r *ProgressReporter) Skip(slices int, bytes int64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.progress.DoneSlices += slices
+	r.progress.DoneBytes += bytes
+	r.emit(false)
+}
+
+// Add 记录新传输的字节数
+func (r *ProgressReporter) Add(bytes int64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.progress.DoneBytes += bytes
+	r.transferred += bytes
+	r.emit(false)
+}
+
+// SliceDone 记录一个分片传输完成
+func (r *ProgressReporter) SliceDone(bytes int64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.progress.DoneSlices++
+	r.progress.DoneBytes += bytes
+	r.transferred += bytes
+	r.emit(false)
+}
+
+// SetTotal 设置文件大小，事先不知道文件大小时在得到响应后设置
+func (r *ProgressReporter) SetTotal(bytes int64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.progress.TotalBytes = bytes
+}
+
+// Restart 整个文件重新开始传输，已完成的字节数回到done，如从断点处续传时为断点位置
+func (r *ProgressReporter) Restart(done int64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.progress.DoneBytes = done
+	r.emit(false)
+}
+
+// Retry 记录一次重试
+func (r *ProgressReporter) Retry() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.progress.Retries++
+	r.emit(false)
+}
+
+// Finish 传输结束，发出结束事件，之后的调用都被忽略
+func (r *ProgressReporter) Finish(err error) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.progress.Finished {
+		return
+	}
+	r.progress.Finished = true
+	r.progress.Err = err
+	r.emit(true)
+}
+
+// Reader 返回一个读取时记录传输字节数的Reader
+func (r *ProgressReporter) Reader(rd io.Reader) io.Reader {
+	if r == nil {
+		return rd
+	}
+	return &progressReader{r: rd, reporter: r}
+}
+
+// 计算速度和剩余时间后调用回调，force为false时按ProgressInterval限频，调用时需要持有锁
+func (r *ProgressReporter) emit(force bool) {
+	if r.progress.Finished && !force {
+		return
+	}
+	now := time.Now()
+	if !force && now.Sub(r.lastEmit) < ProgressInterval {
+		return
+	}
+	r.lastEmit = now
+
+	p := &r.progress
+	p.Elapsed = now.Sub(r.start)
+	p.Rate = 0
+	p.ETA = 0
+	if p.Elapsed > 0 {
+		p.Rate = float64(r.transferred) / p.Elapsed.Seconds()
+	}
+	if p.Rate > 0 && p.TotalBytes > p.DoneBytes && !p.Finished {
+		p.ETA = time.Duration(float64(p.TotalBytes-p.DoneBytes) / p.Rate * float64(time.Second))
+	}
+	r.fn(*p)
+}
+
+// 读取时记录字节数的Reader
+type progressReader struct {
+	r        io.Reader
+	reporter *ProgressReporter
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.reporter.Add(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,244 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateLimitChunk = 32 * 1024 // 限速时每次读取的最大字节数，避免一次读取等待过久
+
+// RateRule 一个时间段内的限速，Start和End为从零点开始的分钟数，Start大于End时跨越零点
+type RateRule struct {
+	Start int   // 开始时间，包含
+	End   int   // 结束时间，不包含
+	Rate  int64 // 限速，字节每秒，0表示不限速
+}
+
+// RateSchedule 按时间段配置的限速，不在任何时间段内时使用Default
+type RateSchedule struct {
+	Default int64      // 默认限速，字节每秒，0表示不限速
+	Rules   []RateRule // 按时间段的限速，前面的优先
+}
+
+// ParseRateSchedule 解析限速配置，多项之间用逗号分隔，每项为"HH:MM-HH:MM=速度"或单独的默认速度，
+// 速度可以带K、M、G后缀（按1024计算），0或unlimited表示不限速，
+// 如"09:00-18:00=10M,0"表示工作时间限速10MB/s，其他时间不限速，空字符串返回nil
+func ParseRateSchedule(s string) (*RateSchedule, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	schedule := &RateSchedule{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		idx := strings.Index(item, "=")
+		if idx < 0 {
+			rate, err := ParseRate(item)
+			if err != nil {
+				return nil, err
+			}
+			schedule.Default = rate
+			continue
+		}
+
+		period := strings.SplitN(item[:idx], "-", 2)
+		if len(period) != 2 {
+			return nil, errors.New("invalid rate schedule entry: " + item)
+		}
+		start, err := parseClock(period[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(period[1])
+		if err != nil {
+			return nil, err
+		}
+		rate, err := ParseRate(item[idx+1:])
+		if err != nil {
+			return nil, err
+		}
+		schedule.Rules = append(schedule.Rules, RateRule{Start: start, End: end, Rate: rate})
+	}
+	return schedule, nil
+}
+
+// 解析HH:MM格式的时间，返回从零点开始的分钟数
+func parseClock(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, errors.New("invalid time: " + s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ParseRate 解析速度，如1024、512K、10M、1G，单位为字节每秒，0或unlimited表示不限速
+func ParseRate(rate string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(rate))
+	if s == "UNLIMITED" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/S"), "B")
+	s = strings.TrimSuffix(s, "I")
+
+	unit := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			unit = 1024
+		case 'M':
+			unit = 1024 * 1024
+		case 'G':
+			unit = 1024 * 1024 * 1024
+		}
+		if unit != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value < 0 {
+		return 0, errors.New("invalid rate: " + rate)
+	}
+	return int64(value * float64(unit)), nil
+}
+
+// ParseSize 解析大小，如4096、512K、4M，单位为字节
+func ParseSize(size string) (int64, error) {
+	if strings.EqualFold(strings.TrimSpace(size), "unlimited") {
+		return 0, errors.New("invalid size: " + size)
+	}
+	value, err := ParseRate(size)
+	if err != nil {
+		return 0, errors.New("invalid size: " + size)
+	}
+	return value, nil
+}
+
+// RateAt 获取某个时刻的限速，0表示不限速
+func (s *RateSchedule) RateAt(t time.Time) int64 {
+	if s == nil {
+		return 0
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	for _, rule := range s.Rules {
+		if rule.Start <= rule.End {
+			if minute >= rule.Start && minute < rule.End {
+				return rule.Rate
+			}
+		} else if minute >= rule.Start || minute < rule.End {
+			return rule.Rate
+		}
+	}
+	return s.Default
+}
+
+// RateLimiter 令牌桶限速器，速度按限速配置随时间变化，可以被多个传输共享，为nil时不限速
+type RateLimiter struct {
+	lock     sync.Mutex
+	schedule *RateSchedule
+	tokens   float64   // 桶中剩余的令牌，即可以立即传输的字节数，为负时表示需要等待
+	last     time.Time // 上次补充令牌的时间
+}
+
+// NewRateLimiter 按限速配置新建一个限速器，schedule为nil时返回nil
+func NewRateLimiter(schedule *RateSchedule) *RateLimiter {
+	if schedule == nil {
+		return nil
+	}
+	return &RateLimiter{schedule: schedule, last: time.Now()}
+}
+
+// WaitN 消耗n个字节的令牌，令牌不够时等待，ctx取消时返回ctx.Err()
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	rate := float64(l.schedule.RateAt(now))
+	if rate <= 0 {
+		// 不限速的时间段不积累令牌
+		l.tokens = 0
+		l.last = now
+		l.lock.Unlock()
+		return nil
+	}
+
+	// 桶容量为一秒的传输量，至少能放下一次读取的数据
+	burst := rate
+	if burst < rateLimitChunk {
+		burst = rateLimitChunk
+	}
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 读取时按限速器等待的Reader
+type rateLimitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+// LimitReader 返回一个按限速器限速的Reader，可以同时受多个限速器限制，如全局限速和单个文件的限速，
+// 限速器都为nil时直接返回r
+func LimitReader(ctx context.Context, r io.Reader, limiters ...*RateLimiter) io.Reader {
+	active := []*RateLimiter{}
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiters: active}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		for _, l := range r.limiters {
+			if waitErr := l.WaitN(r.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,239 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RetryableHeader 服务端在4xx响应中带上该请求头，表示错误是传输过程导致的，如分片校验失败，可以重试
+const RetryableHeader = "X-Retryable"
+
+// ErrRetryBudgetExhausted 重试次数用完
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// ErrIdleTimeout 重试时距上次传输有进展已超过IdleTimeout
+var ErrIdleTimeout = errors.New("no progress within idle timeout")
+
+// TransferError 传输请求失败的原因，区分可以重试的错误（网络错误、5xx、429等）和重试也不会成功的错误
+type TransferError struct {
+	Op         string        // 失败的操作
+	StatusCode int           // http状态码，网络错误时为0
+	Retryable  bool          // 是否可以重试
+	RetryAfter time.Duration // 服务端要求的重试等待时间，0表示没有要求
+	Err        error         // 原始错误
+}
+
+func (e *TransferError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s failed, status %d: %s", e.Op, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("%s failed: %s", e.Op, e.Err)
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// NetworkError 请求没有得到响应时的错误，取消和超时不可重试，其他的都可以重试
+func NetworkError(op string, err error) *TransferError {
+	return &TransferError{
+		Op:        op,
+		Retryable: !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded),
+		Err:       err,
+	}
+}
+
+// StatusError 根据非200的响应生成错误，会读取响应体作为错误信息，
+// 408、429和5xx可以重试，其他状态码只有带上RetryableHeader时才重试
+func StatusError(op string, resp *http.Response) *TransferError {
+	msg, _ := ioutil.ReadAll(resp.Body)
+	code := resp.StatusCode
+	return &TransferError{
+		Op:         op,
+		StatusCode: code,
+		Retryable: code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500 ||
+			resp.Header.Get(RetryableHeader) == "true",
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		Err:        errors.New(strings.TrimSpace(string(msg))),
+	}
+}
+
+// 解析Retry-After，可以是秒数或者http时间
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// IsRetryable 判断错误是否值得重试，只有标明可以重试的TransferError才重试，
+// 其他错误如本地文件不存在，重试也不会成功
+func IsRetryable(err error) bool {
+	var transferErr *TransferError
+	if errors.As(err, &transferErr) {
+		return transferErr.Retryable
+	}
+	return false
+}
+
+// RetryPolicy 重试策略，等待时间按指数增长并加入随机抖动，避免大量请求同时重试
+type RetryPolicy struct {
+	BaseDelay          time.Duration // 第一次重试的等待时间
+	MaxDelay           time.Duration // 等待时间的上限
+	MaxSliceRetries    int           // 每个分片最多重试的次数
+	MaxTransferRetries int           // 每个文件一次传输中所有分片合计最多重试的次数
+	IdleTimeout        time.Duration // 重试时距上次传输有进展超过该时间则放弃，0表示不限制
+}
+
+// DefaultRetryPolicy 默认的重试策略
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		BaseDelay:          500 * time.Millisecond,
+		MaxDelay:           30 * time.Second,
+		MaxSliceRetries:    5,
+		MaxTransferRetries: 50,
+		IdleTimeout:        IdleTimeout * time.Second,
+	}
+}
+
+var jitter = struct {
+	lock sync.Mutex
+	rand *rand.Rand
+}{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Backoff 计算第attempt次重试（从0开始）前的等待时间，取指数退避的一半加上随机的另一半，
+// 服务端要求的等待时间更长时以服务端为准
+func (p RetryPolicy) Backoff(attempt int, retryAfter time.Duration) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay > 0 {
+		jitter.lock.Lock()
+		delay = delay/2 + time.Duration(jitter.rand.Int63n(int64(delay/2)+1))
+		jitter.lock.Unlock()
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
+
+// RetryBudget 一次传输的重试预算，记录每个分片和整个传输的重试次数以及上次有进展的时间，
+// 遇到不可重试的错误、次数用完或长时间没有进展时记下失败原因
+type RetryBudget struct {
+	lock     sync.Mutex
+	policy   RetryPolicy
+	attempts map[int]int // 每个分片已重试的次数
+	total    int         // 所有分片合计已重试的次数
+	err      error       // 导致传输失败的错误
+	progress int64       // 上次有进展的时间，UnixNano，原子读写
+}
+
+// NewRetryBudget 按重试策略新建一个重试预算
+func NewRetryBudget(policy RetryPolicy) *RetryBudget {
+	return &RetryBudget{policy: policy, attempts: make(map[int]int), progress: time.Now().UnixNano()}
+}
+
+// Progress 记下传输有了进展，如完成一个分片或收发了数据
+func (b *RetryBudget) Progress() {
+	atomic.StoreInt64(&b.progress, time.Now().UnixNano())
+}
+
+// Reader 每读到数据都记为一次进展
+func (b *RetryBudget) Reader(r io.Reader) io.Reader {
+	return &idleReader{r: r, budget: b}
+}
+
+type idleReader struct {
+	r      io.Reader
+	budget *RetryBudget
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.budget.Progress()
+	}
+	return n, err
+}
+
+// Next 分片index因err失败后，判断是否还能重试，可以时返回重试前的等待时间，
+// 不能重试时返回传输失败的原因
+func (b *RetryBudget) Next(index int, err error) (time.Duration, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !IsRetryable(err) {
+		b.fail(err)
+		return 0, err
+	}
+
+	b.attempts[index]++
+	b.total++
+	if b.attempts[index] > b.policy.MaxSliceRetries || b.total > b.policy.MaxTransferRetries {
+		err = fmt.Errorf("%w, last error: %v", ErrRetryBudgetExhausted, err)
+		b.fail(err)
+		return 0, err
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&b.progress)))
+	if b.policy.IdleTimeout > 0 && idle > b.policy.IdleTimeout {
+		err = fmt.Errorf("%w (%s), last error: %v", ErrIdleTimeout, b.policy.IdleTimeout, err)
+		b.fail(err)
+		return 0, err
+	}
+
+	var retryAfter time.Duration
+	var transferErr *TransferError
+	if errors.As(err, &transferErr) {
+		retryAfter = transferErr.RetryAfter
+	}
+	return b.policy.Backoff(b.attempts[index]-1, retryAfter), nil
+}
+
+// 记下第一个导致传输失败的错误，调用时需要持有锁
+func (b *RetryBudget) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Err 导致传输失败的错误，还没有失败时返回nil
+func (b *RetryBudget) Err() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.err
+}
+
+// Sleep 等待d，ctx取消时提前返回ctx.Err()
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
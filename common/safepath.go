@@ -0,0 +1,57 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafeName 名称可能指向目标目录之外，用errors.Is判断
+var ErrUnsafeName = errors.New("unsafe name")
+
+// UnsafeNameError 请求的或服务端返回的文件名、fid不安全时返回的错误
+type UnsafeNameError struct {
+	Field string // 名称的用途，如filename、fid
+	Name  string // 被拒绝的名称
+}
+
+func (e *UnsafeNameError) Error() string {
+	return fmt.Sprintf("unsafe %s: %q", e.Field, e.Name)
+}
+
+func (e *UnsafeNameError) Unwrap() error {
+	return ErrUnsafeName
+}
+
+// CheckName 检查名称只有一级，拼接到目录下后不会指向目录之外：
+// 不能为空、.或..，不能包含路径分隔符、盘符或NUL，不合法时返回*UnsafeNameError
+func CheckName(field string, name string) error {
+	if name == "" || name == "." || name == ".." ||
+		strings.ContainsAny(name, "/\\\x00") || filepath.VolumeName(name) != "" {
+		return &UnsafeNameError{Field: field, Name: name}
+	}
+	return nil
+}
+
+// CheckPath 检查以/分隔的相对路径，每一级都要符合CheckName，不合法时返回*UnsafeNameError
+func CheckPath(field string, name string) error {
+	if name == "" {
+		return &UnsafeNameError{Field: field, Name: name}
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if CheckName(field, elem) != nil {
+			return &UnsafeNameError{Field: field, Name: name}
+		}
+	}
+	return nil
+}
+
+// SafeJoin 把以/分隔的相对路径拼接到目录下，路径不合法时返回*UnsafeNameError
+func SafeJoin(dir string, field string, name string) (string, error) {
+	err := CheckPath(field, name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
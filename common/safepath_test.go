@@ -0,0 +1,115 @@
+package common
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{".env", true},
+		{"...", true},
+		{"a..b", true},
+		{"中文.pdf", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"a/b", false},
+		{"/etc", false},
+		{"a\\b", false},
+		{"..\\x", false},
+		{"a\x00b", false},
+	}
+	for _, tt := range tests {
+		err := CheckName("name", tt.name)
+		if tt.ok && err != nil {
+			t.Errorf("CheckName(%q) = %v, want nil", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrUnsafeName) {
+			t.Errorf("CheckName(%q) = %v, want ErrUnsafeName", tt.name, err)
+		}
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"dir/a.txt", true},
+		{".config/app/.env", true},
+		{"a/..b/c", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../x", false},
+		{"a/../b", false},
+		{"a/./b", false},
+		{"a/..", false},
+		{"/etc/passwd", false},
+		{"a//b", false},
+		{"a/", false},
+		{"a\\..\\b", false},
+		{"..\\x", false},
+		{"a/b\x00c", false},
+	}
+	for _, tt := range tests {
+		err := CheckPath("filename", tt.name)
+		if tt.ok && err != nil {
+			t.Errorf("CheckPath(%q) = %v, want nil", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrUnsafeName) {
+			t.Errorf("CheckPath(%q) = %v, want ErrUnsafeName", tt.name, err)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	dir := filepath.Join("data", "download")
+	tests := []struct {
+		name string
+		want string // 为空表示应当拒绝
+	}{
+		{"a.txt", filepath.Join(dir, "a.txt")},
+		{"sub/dir/a.txt", filepath.Join(dir, "sub", "dir", "a.txt")},
+		{".env", filepath.Join(dir, ".env")},
+		{"", ""},
+		{"..", ""},
+		{"../x", ""},
+		{"a/../../x", ""},
+		{"a/../b", ""},
+		{"/etc/passwd", ""},
+		{"..\\x", ""},
+		{"x\x00", ""},
+	}
+	for _, tt := range tests {
+		got, err := SafeJoin(dir, "filename", tt.name)
+		if tt.want == "" {
+			var unsafeErr *UnsafeNameError
+			if !errors.As(err, &unsafeErr) || unsafeErr.Name != tt.name || unsafeErr.Field != "filename" {
+				t.Errorf("SafeJoin(%q) error = %v, want *UnsafeNameError for %q", tt.name, err, tt.name)
+			}
+			if got != "" {
+				t.Errorf("SafeJoin(%q) = %q, want empty path on error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SafeJoin(%q) error = %v, want nil", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("SafeJoin(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if !strings.HasPrefix(got, dir+string(filepath.Separator)) {
+			t.Errorf("SafeJoin(%q) = %q escapes %q", tt.name, got, dir)
+		}
+	}
+}
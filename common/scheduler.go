@@ -0,0 +1,151 @@
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// Scheduler 进程级的传输调度器，限制所有文件同时进行的分片请求总数，
+// 名额在等待中的文件之间轮流分配，开启SmallFirst时优先分配给小文件
+type Scheduler struct {
+	lock       sync.Mutex
+	limit      int         // 同时进行的分片请求上限，小于等于0表示不限制
+	smallFirst bool        // 是否优先传输小文件
+	running    int         // 进行中的分片请求数
+	transfers  []*Transfer // 登记的传输文件，按登记顺序轮流分配名额
+	next       int         // 下一次轮询开始的位置
+}
+
+// Transfer 在调度器中登记的一个传输文件，分片请求前获取名额，结束后归还
+type Transfer struct {
+	sched   *Scheduler
+	name    string    // 文件名，仅用于展示
+	size    int64     // 文件大小，小文件优先时使用
+	waiters waitQueue // 等待名额的分片请求
+}
+
+// DefaultScheduler 默认的全局调度器，NewConfig创建的配置都共用它
+var DefaultScheduler = NewScheduler(TransferMaxNum)
+
+// NewScheduler 新建一个调度器，limit为同时进行的分片请求上限
+func NewScheduler(limit int) *Scheduler {
+	return &Scheduler{limit: limit}
+}
+
+// SetLimit 修改同时进行的分片请求上限，小于等于0表示不限制
+func (s *Scheduler) SetLimit(limit int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.limit = limit
+	s.dispatch()
+}
+
+// SetSmallFirst 设置是否优先把名额分配给小文件
+func (s *Scheduler) SetSmallFirst(smallFirst bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.smallFirst = smallFirst
+}
+
+// Register 登记一个传输文件，传输结束后需要调用Done注销，调度器为nil时返回nil，不做限制
+func (s *Scheduler) Register(name string, size int64) *Transfer {
+	if s == nil {
+		return nil
+	}
+
+	t := &Transfer{sched: s, name: name, size: size}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.transfers = append(s.transfers, t)
+	return t
+}
+
+// 把空闲名额分配给等待中的文件，调用时需要持有锁
+func (s *Scheduler) dispatch() {
+	for s.limit <= 0 || s.running < s.limit {
+		t := s.pick()
+		if t == nil {
+			return
+		}
+		s.running++
+		t.waiters.grant()
+	}
+}
+
+// 选出下一个获得名额的文件，从上次的位置开始轮询，小文件优先时选等待中最小的文件，
+// 大小相同的仍按轮询顺序
+func (s *Scheduler) pick() *Transfer {
+	var picked *Transfer
+	pickedIdx := 0
+	for k := 0; k < len(s.transfers); k++ {
+		idx := (s.next + k) % len(s.transfers)
+		t := s.transfers[idx]
+		if t.waiters.len() == 0 {
+			continue
+		}
+		if picked == nil || (s.smallFirst && t.size < picked.size) {
+			picked = t
+			pickedIdx = idx
+		}
+		if !s.smallFirst {
+			break
+		}
+	}
+	if picked != nil {
+		s.next = pickedIdx + 1
+	}
+	return picked
+}
+
+// Acquire 获取一个分片请求名额，ctx取消时放弃等待并返回ctx.Err()
+func (t *Transfer) Acquire(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	s := t.sched
+	s.lock.Lock()
+	waiter := t.waiters.push()
+	s.dispatch()
+	s.lock.Unlock()
+	// 取消的同时分到了名额时还回去给其他文件
+	return t.waiters.wait(ctx, &s.lock, waiter, s.release)
+}
+
+// Release 归还Acquire获取的名额
+func (t *Transfer) Release() {
+	if t == nil {
+		return
+	}
+
+	s := t.sched
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.release()
+}
+
+// 归还名额并分配给等待中的文件，调用时需要持有锁
+func (s *Scheduler) release() {
+	s.running--
+	s.dispatch()
+}
+
+// Done 传输结束，从调度器中注销
+func (t *Transfer) Done() {
+	if t == nil {
+		return
+	}
+
+	s := t.sched
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, other := range s.transfers {
+		if other == t {
+			s.transfers = append(s.transfers[:i], s.transfers[i+1:]...)
+			if i < s.next {
+				s.next--
+			}
+			break
+		}
+	}
+}
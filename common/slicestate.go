@@ -0,0 +1,135 @@
+package common
+
+import "sync"
+
+// SliceState 分片在一次传输中的状态
+type SliceState int
+
+const (
+	SlicePending  SliceState = iota // 等待传输，包括等待重试
+	SliceInflight                   // 正在传输
+	SliceDone                       // 传输完成
+	SliceFailed                     // 不再传输，出错不能重试或传输被取消
+)
+
+// SliceTracker 记录一次传输中每个分片的状态，状态只能按
+// pending -> inflight -> done/failed、inflight -> pending（重试）、pending -> failed 转换，
+// 不合法的转换会被忽略，因此同一个分片不会被重复计数。
+// Seal之后所有分片都处于done或failed时，Done返回的通道被关闭
+type SliceTracker struct {
+	lock      sync.Mutex
+	states    map[int]SliceState
+	remaining int           // 处于pending或inflight的分片数
+	sealed    bool          // 是否已不再添加分片
+	done      chan struct{} // 所有分片结束后关闭
+}
+
+// NewSliceTracker 新建一个分片状态记录
+func NewSliceTracker() *SliceTracker {
+	return &SliceTracker{
+		states: make(map[int]SliceState),
+		done:   make(chan struct{}),
+	}
+}
+
+// Add 添加一个等待传输的分片，已添加过的分片返回false
+func (t *SliceTracker) Add(index int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.states[index]; ok || t.sealed {
+		return false
+	}
+	t.states[index] = SlicePending
+	t.remaining++
+	return true
+}
+
+// 状态从from中的一个转换到to，调用时需要持有锁
+func (t *SliceTracker) transit(index int, to SliceState, from ...SliceState) bool {
+	state, ok := t.states[index]
+	if !ok {
+		return false
+	}
+	for _, f := range from {
+		if state == f {
+			t.states[index] = to
+			if to == SliceDone || to == SliceFailed {
+				t.remaining--
+				t.checkDone()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// 所有分片都结束时发出结束信号，调用时需要持有锁
+func (t *SliceTracker) checkDone() {
+	if t.sealed && t.remaining == 0 {
+		select {
+		case <-t.done:
+		default:
+			close(t.done)
+		}
+	}
+}
+
+// Start 分片开始传输，分片不处于pending时返回false，调用方不应再传输它
+func (t *SliceTracker) Start(index int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.transit(index, SliceInflight, SlicePending)
+}
+
+// Retry 传输失败的分片回到pending，等待重试
+func (t *SliceTracker) Retry(index int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.transit(index, SlicePending, SliceInflight)
+}
+
+// Finish 分片传输完成
+func (t *SliceTracker) Finish(index int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.transit(index, SliceDone, SliceInflight)
+}
+
+// Fail 分片不再传输
+func (t *SliceTracker) Fail(index int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.transit(index, SliceFailed, SlicePending, SliceInflight)
+}
+
+// Seal 不再添加分片，之后所有分片结束时发出结束信号
+func (t *SliceTracker) Seal() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sealed = true
+	t.checkDone()
+}
+
+// Done 所有分片结束后关闭的通道
+func (t *SliceTracker) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait 不再添加分片，并等待所有分片结束
+func (t *SliceTracker) Wait() {
+	t.Seal()
+	<-t.done
+}
+
+// Count 处于某个状态的分片数量
+func (t *SliceTracker) Count(state SliceState) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	count := 0
+	for _, s := range t.states {
+		if s == state {
+			count++
+		}
+	}
+	return count
+}
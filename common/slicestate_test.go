@@ -0,0 +1,221 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 结束信号是否已发出
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSliceTrackerFinishTwice(t *testing.T) {
+	tracker := NewSliceTracker()
+	tracker.Add(0)
+	tracker.Add(1)
+	tracker.Seal()
+
+	if !tracker.Start(0) {
+		t.Fatal("Start(0) = false, want true")
+	}
+	if !tracker.Finish(0) {
+		t.Fatal("first Finish(0) = false, want true")
+	}
+	if tracker.Finish(0) {
+		t.Error("second Finish(0) = true, want false")
+	}
+	if tracker.Fail(0) {
+		t.Error("Fail(0) after Finish = true, want false")
+	}
+	// 重复结束不能让计数减到0，分片1还没结束
+	if isClosed(tracker.Done()) {
+		t.Fatal("Done closed while slice 1 is still pending")
+	}
+	if got := tracker.Count(SliceDone); got != 1 {
+		t.Errorf("Count(SliceDone) = %d, want 1", got)
+	}
+}
+
+func TestSliceTrackerFailTwice(t *testing.T) {
+	tracker := NewSliceTracker()
+	tracker.Add(0)
+	tracker.Add(1)
+	tracker.Seal()
+
+	tracker.Start(0)
+	if !tracker.Fail(0) {
+		t.Fatal("first Fail(0) = false, want true")
+	}
+	if tracker.Fail(0) {
+		t.Error("second Fail(0) = true, want false")
+	}
+	if tracker.Finish(0) {
+		t.Error("Finish(0) after Fail = true, want false")
+	}
+	if isClosed(tracker.Done()) {
+		t.Fatal("Done closed while slice 1 is still pending")
+	}
+
+	// 没有开始传输的分片也可以直接失败
+	if !tracker.Fail(1) {
+		t.Fatal("Fail(1) on pending slice = false, want true")
+	}
+	if !isClosed(tracker.Done()) {
+		t.Fatal("Done not closed after all slices ended")
+	}
+	if got := tracker.Count(SliceFailed); got != 2 {
+		t.Errorf("Count(SliceFailed) = %d, want 2", got)
+	}
+}
+
+func TestSliceTrackerRetryAfterFail(t *testing.T) {
+	tracker := NewSliceTracker()
+	tracker.Add(0)
+	tracker.Seal()
+
+	tracker.Start(0)
+	tracker.Fail(0)
+	if tracker.Retry(0) {
+		t.Error("Retry(0) after Fail = true, want false")
+	}
+	if tracker.Start(0) {
+		t.Error("Start(0) after Fail = true, want false")
+	}
+	if got := tracker.Count(SliceFailed); got != 1 {
+		t.Errorf("Count(SliceFailed) = %d, want 1", got)
+	}
+	if !isClosed(tracker.Done()) {
+		t.Fatal("Done not closed after the only slice failed")
+	}
+}
+
+func TestSliceTrackerRetry(t *testing.T) {
+	tracker := NewSliceTracker()
+	tracker.Add(0)
+	tracker.Seal()
+
+	tracker.Start(0)
+	if !tracker.Retry(0) {
+		t.Fatal("Retry(0) on inflight slice = false, want true")
+	}
+	if tracker.Retry(0) {
+		t.Error("Retry(0) on pending slice = true, want false")
+	}
+	if !tracker.Start(0) || !tracker.Finish(0) {
+		t.Fatal("retried slice could not be started and finished")
+	}
+	if !isClosed(tracker.Done()) {
+		t.Fatal("Done not closed after the only slice finished")
+	}
+}
+
+func TestSliceTrackerSealEmpty(t *testing.T) {
+	tracker := NewSliceTracker()
+	if isClosed(tracker.Done()) {
+		t.Fatal("Done closed before Seal")
+	}
+	tracker.Seal()
+	if !isClosed(tracker.Done()) {
+		t.Fatal("Done not closed after Seal with no slices")
+	}
+	if tracker.Add(0) {
+		t.Error("Add after Seal = true, want false")
+	}
+	// 重复Seal不能重复关闭通道
+	tracker.Seal()
+	tracker.Wait()
+}
+
+func TestSliceTrackerUnknownSlice(t *testing.T) {
+	tracker := NewSliceTracker()
+	if tracker.Start(3) || tracker.Finish(3) || tracker.Fail(3) || tracker.Retry(3) {
+		t.Error("transition on a slice that was never added succeeded")
+	}
+	if !tracker.Add(3) {
+		t.Fatal("Add(3) = false, want true")
+	}
+	if tracker.Add(3) {
+		t.Error("second Add(3) = true, want false")
+	}
+}
+
+func TestSliceTrackerConcurrent(t *testing.T) {
+	const slices = 200
+	tracker := NewSliceTracker()
+	var ended int64
+	var wg sync.WaitGroup
+	for i := 0; i < slices; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			if !tracker.Add(index) {
+				t.Errorf("Add(%d) = false, want true", index)
+				return
+			}
+			// 多个goroutine同时传输同一个分片，模拟重复的重试和迟到的响应
+			var workers sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				workers.Add(1)
+				go func(w int) {
+					defer workers.Done()
+					for attempt := 0; attempt < 3; attempt++ {
+						if !tracker.Start(index) {
+							continue
+						}
+						if attempt < 2 && (index+w)%2 == 0 {
+							tracker.Retry(index)
+							continue
+						}
+						ok := false
+						if (index+w)%3 == 0 {
+							ok = tracker.Fail(index)
+						} else {
+							ok = tracker.Finish(index)
+						}
+						if ok {
+							atomic.AddInt64(&ended, 1)
+							return
+						}
+					}
+					// 没能结束分片时让它失败，保证每个分片最后都会结束
+					if tracker.Fail(index) {
+						atomic.AddInt64(&ended, 1)
+					}
+				}(w)
+			}
+			// 同时读取状态计数
+			tracker.Count(SliceInflight)
+			workers.Wait()
+		}(i)
+	}
+	wg.Wait()
+
+	waited := make(chan struct{})
+	go func() {
+		tracker.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Wait did not return, %d slices pending, %d inflight",
+			tracker.Count(SlicePending), tracker.Count(SliceInflight))
+	}
+
+	// 每个分片恰好结束一次
+	if ended != slices {
+		t.Errorf("%d successful Finish/Fail calls, want %d", ended, slices)
+	}
+	done, failed := tracker.Count(SliceDone), tracker.Count(SliceFailed)
+	if done+failed != slices {
+		t.Errorf("%d done + %d failed slices, want %d in total", done, failed, slices)
+	}
+}
@@ -1,9 +1,14 @@
 package common
 
 import (
+	"context"
 	"encoding/gob"
-	"fmt"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
 	"os"
+	"strings"
+	"time"
 )
 
 // IsDir 判断所给路径是否为文件夹
@@ -24,11 +29,25 @@ func IsFile(path string) bool {
 	return !s.IsDir()
 }
 
+// IsTransferStateFile 判断是否是断点续传时保存在文件旁边的隐藏状态文件，
+// 如.abc.pdf.uploading、.abc.pdf.part，它们不是用户的文件
+func IsTransferStateFile(name string) bool {
+	if !strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, suffix := range []string{".uploading", ".downloading", ".part", ".resume"} {
+		if len(name) > len(suffix)+1 && strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetFileSize 获取文件大小
 func GetFileSize(path string) int64 {
 	fh, err := os.Stat(path)
 	if err != nil {
-		fmt.Printf("读取文件%s失败, err: %s\n", path, err)
+		Logger().Error("file.stat_failed", "path", path, "err", err)
 	}
 	return fh.Size()
 }
@@ -36,9 +55,9 @@ func GetFileSize(path string) int64 {
 // StoreMetadata 保存文件元数据
 func StoreMetadata(filePath string, metadata *FileMetadata) (error) {
 	// 写入文件
-	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0666)
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		fmt.Printf("写元数据文件%s失败\n", filePath)
+		Logger().Error("meta.store_failed", "path", filePath, "err", err)
 		return err
 	}
 	defer file.Close()
@@ -46,8 +65,48 @@ func StoreMetadata(filePath string, metadata *FileMetadata) (error) {
 	enc := gob.NewEncoder(file)
 	err = enc.Encode(metadata)
 	if err != nil {
-		fmt.Printf("写元数据文件%s失败\n", filePath)
+		Logger().Error("meta.store_failed", "path", filePath, "err", err)
 		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// GraceContext 返回一个不随parent立即取消的context，parent被取消grace时间之后才会被取消，
+// 用于让已经发出的请求在停止传输后还有时间完成
+func GraceContext(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-parent.Done():
+			timer := time.NewTimer(grace)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				cancel()
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// 分片校验使用CRC32C，计算快且能发现传输中的位错误
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// NewSliceHash 新建一个分片校验值计算器
+func NewSliceHash() hash.Hash32 {
+	return crc32.New(crc32cTable)
+}
+
+// SliceChecksum 计算分片数据的校验值
+func SliceChecksum(data []byte) string {
+	h := NewSliceHash()
+	h.Write(data)
+	return FormatSliceChecksum(h)
+}
+
+// FormatSliceChecksum 将分片校验值格式化为十六进制字符串
+func FormatSliceChecksum(h hash.Hash32) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
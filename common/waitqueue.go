@@ -0,0 +1,56 @@
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// waitQueue 等待名额的请求队列，按先来先得分配，Concurrency和Scheduler共用，
+// 除wait外的方法调用时都需要持有使用者保护队列的锁
+type waitQueue struct {
+	waiters []chan struct{}
+}
+
+// len 等待中的请求数
+func (q *waitQueue) len() int {
+	return len(q.waiters)
+}
+
+// push 加入一个等待者，分到名额时它会被关闭
+func (q *waitQueue) push() chan struct{} {
+	waiter := make(chan struct{})
+	q.waiters = append(q.waiters, waiter)
+	return waiter
+}
+
+// grant 把名额分给最早的等待者
+func (q *waitQueue) grant() {
+	waiter := q.waiters[0]
+	q.waiters = q.waiters[1:]
+	close(waiter)
+}
+
+// wait 等待waiter分到名额，调用时不持有lock，ctx取消时放弃等待并返回ctx.Err()，
+// 取消的同时分到了名额则在持有lock时调用giveBack还回去
+func (q *waitQueue) wait(ctx context.Context, lock sync.Locker, waiter chan struct{}, giveBack func()) error {
+	select {
+	case <-waiter:
+		return nil
+	case <-ctx.Done():
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	select {
+	case <-waiter:
+		giveBack()
+	default:
+		for i, w := range q.waiters {
+			if w == waiter {
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	return ctx.Err()
+}
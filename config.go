@@ -0,0 +1,191 @@
+package main
+
+import (
+    "FtpClient/common"
+    "errors"
+    "flag"
+    "fmt"
+    "github.com/BurntSushi/toml"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "unicode"
+)
+
+// 参数的来源按优先级从高到低为：
+//   1. 命令行参数
+//   2. 环境变量，参数名转成大写下划线形式并加上FTPCLIENT_前缀，如downloadDir对应FTPCLIENT_DOWNLOAD_DIR，serverIP对应FTPCLIENT_SERVER_IP，log-level对应FTPCLIENT_LOG_LEVEL
+//   3. 配置文件中选中的profile，键为参数名的小写下划线形式，如download_dir
+//   4. 参数的默认值
+// 配置文件由--config、FTPCLIENT_CONFIG指定，默认为用户配置目录下的ftpclient/config.toml；
+// profile由--profile、FTPCLIENT_PROFILE指定，默认为配置文件中的default_profile。配置文件示例：
+//
+//   default_profile = "work"
+//
+//   [profiles.work]
+//   server = "http://10.0.0.1:800"
+//   credentials = "env:FTP_TOKEN"
+//   slice_size = "4M"
+//   concurrency = 8
+//   upload_limit = "09:00-18:00=10M,0"
+//   download_dir = "/data/download"
+
+const envPrefix = "FTPCLIENT_" // 环境变量前缀
+
+// configFile 配置文件的内容
+type configFile struct {
+    DefaultProfile string                            `toml:"default_profile"` // 没有指定profile时使用的profile
+    Profiles       map[string]map[string]interface{} `toml:"profiles"`        // 按名称保存的profile，键为参数名的小写下划线形式
+}
+
+// 把参数名转成小写下划线形式，如downloadDir转成download_dir，log-level转成log_level，
+// 连续的大写字母作为一个单词，如serverIP转成server_ip，HTTPProxy转成http_proxy
+func flagKey(name string) string {
+    runes := []rune(name)
+    var b strings.Builder
+    for i, r := range runes {
+        switch {
+        case r == '-':
+            b.WriteRune('_')
+        case unicode.IsUpper(r):
+            // 小写字母或数字之后开始新单词，连续大写中下一个是小写字母时最后一个大写开始新单词
+            if i > 0 && runes[i-1] != '-' && (!unicode.IsUpper(runes[i-1]) ||
+                (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+                b.WriteRune('_')
+            }
+            b.WriteRune(unicode.ToLower(r))
+        default:
+            b.WriteRune(r)
+        }
+    }
+    return b.String()
+}
+
+// 参数对应的环境变量名
+func envName(name string) string {
+    return envPrefix + strings.ToUpper(flagKey(name))
+}
+
+// 获取配置文件路径，没有指定时使用默认路径，explicit表示是否是指定的路径
+func configPath(explicit map[string]bool) (string, bool) {
+    if explicit["config"] {
+        return *configFilePath, true
+    }
+    if value, ok := os.LookupEnv(envName("config")); ok {
+        return value, true
+    }
+    configDir, err := os.UserConfigDir()
+    if err != nil {
+        return "", false
+    }
+    return filepath.Join(configDir, "ftpclient", "config.toml"), false
+}
+
+// 读取选中的profile，返回参数名到参数值的映射，没有配置文件且没有指定profile时返回nil
+func loadProfile(explicit map[string]bool) (map[string]string, error) {
+    path, pathExplicit := configPath(explicit)
+    name := *profileName
+    if !explicit["profile"] {
+        name = os.Getenv(envName("profile"))
+    }
+
+    var conf configFile
+    _, err := toml.DecodeFile(path, &conf)
+    if os.IsNotExist(err) && !pathExplicit && name == "" {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+    }
+
+    if name == "" {
+        name = conf.DefaultProfile
+    }
+    if name == "" {
+        return nil, nil
+    }
+    profile, ok := conf.Profiles[name]
+    if !ok {
+        return nil, fmt.Errorf("no profile %s in config file %s", name, path)
+    }
+
+    // 配置文件中的键对应到参数名，config和profile只能在命令行或环境变量中指定
+    names := make(map[string]string)
+    flag.VisitAll(func(f *flag.Flag) {
+        if f.Name != "config" && f.Name != "profile" {
+            names[flagKey(f.Name)] = f.Name
+        }
+    })
+
+    values := make(map[string]string)
+    for key, value := range profile {
+        flagName, ok := names[key]
+        if !ok {
+            return nil, fmt.Errorf("unknown key %s in profile %s", key, name)
+        }
+        switch value.(type) {
+        case string, int64, float64, bool:
+            values[flagName] = fmt.Sprint(value)
+        default:
+            return nil, fmt.Errorf("value of %s in profile %s is not a string, number or boolean", key, name)
+        }
+    }
+    return values, nil
+}
+
+// 用环境变量和配置文件中的profile补充命令行没有指定的参数，出错时退出
+func applyConfig() {
+    explicit := make(map[string]bool)
+    flag.Visit(func(f *flag.Flag) {
+        explicit[f.Name] = true
+    })
+
+    profile, err := loadProfile(explicit)
+    if err != nil {
+        common.Logger().Error("cli.config_failed", "err", err)
+        os.Exit(-1)
+    }
+
+    flag.VisitAll(func(f *flag.Flag) {
+        if explicit[f.Name] || f.Name == "config" || f.Name == "profile" {
+            return
+        }
+        source := envName(f.Name)
+        value, ok := os.LookupEnv(source)
+        if !ok {
+            source = "profile"
+            value, ok = profile[f.Name]
+        }
+        if !ok {
+            return
+        }
+        err := flag.Set(f.Name, value)
+        if err != nil {
+            common.Logger().Error("cli.invalid_flag", "flag", f.Name, "source", source, "value", value, "err", err)
+            os.Exit(-1)
+        }
+    })
+}
+
+// 解析凭据引用，env:NAME从环境变量NAME读取，file:PATH从文件读取，不允许直接写凭据本身
+func resolveCredentials(ref string) (string, error) {
+    switch {
+    case ref == "":
+        return "", nil
+    case strings.HasPrefix(ref, "env:"):
+        value, ok := os.LookupEnv(strings.TrimPrefix(ref, "env:"))
+        if !ok {
+            return "", errors.New("token environment variable not set: " + strings.TrimPrefix(ref, "env:"))
+        }
+        return strings.TrimSpace(value), nil
+    case strings.HasPrefix(ref, "file:"):
+        data, err := ioutil.ReadFile(strings.TrimPrefix(ref, "file:"))
+        if err != nil {
+            return "", err
+        }
+        return strings.TrimSpace(string(data)), nil
+    default:
+        return "", errors.New("token reference must be env:NAME or file:PATH")
+    }
+}
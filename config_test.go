@@ -0,0 +1,102 @@
+package main
+
+import (
+    "flag"
+    "strings"
+    "testing"
+)
+
+func TestFlagKey(t *testing.T) {
+    // 所有注册的参数对应的配置文件键
+    keys := map[string]string{
+        "0":                  "0",
+        "action":             "action",
+        "adaptive":           "adaptive",
+        "concurrency":        "concurrency",
+        "config":             "config",
+        "credentials":        "credentials",
+        "directWrite":        "direct_write",
+        "downloadDir":        "download_dir",
+        "downloadFileLimit":  "download_file_limit",
+        "downloadFilenames":  "download_filenames",
+        "downloadLimit":      "download_limit",
+        "dry-run":            "dry_run",
+        "exclude":            "exclude",
+        "exclude-from":       "exclude_from",
+        "gracePeriod":        "grace_period",
+        "historyFile":        "history_file",
+        "idleTimeout":        "idle_timeout",
+        "include":            "include",
+        "lang":               "lang",
+        "log-format":         "log_format",
+        "log-level":          "log_level",
+        "max-size":           "max_size",
+        "maxSliceRetries":    "max_slice_retries",
+        "maxTransferRetries": "max_transfer_retries",
+        "maxTransfers":       "max_transfers",
+        "maxUploadSize":      "max_upload_size",
+        "min-size":           "min_size",
+        "newer-than":         "newer_than",
+        "older-than":         "older_than",
+        "onExist":            "on_exist",
+        "output":             "output",
+        "profile":            "profile",
+        "progress":           "progress",
+        "quiet":              "quiet",
+        "r":                  "r",
+        "server":             "server",
+        "serverIP":           "server_ip",
+        "serverPort":         "server_port",
+        "sliceSize":          "slice_size",
+        "smallFileSize":      "small_file_size",
+        "smallFirst":         "small_first",
+        "storeDir":           "store_dir",
+        "uploadFileLimit":    "upload_file_limit",
+        "uploadFilepaths":    "upload_filepaths",
+        "uploadLimit":        "upload_limit",
+    }
+
+    seen := make(map[string]string)
+    flag.VisitAll(func(f *flag.Flag) {
+        if strings.HasPrefix(f.Name, "test.") {
+            return
+        }
+        want, ok := keys[f.Name]
+        if !ok {
+            t.Errorf("flag %q is missing from the test table", f.Name)
+            return
+        }
+        got := flagKey(f.Name)
+        if got != want {
+            t.Errorf("flagKey(%q) = %q, want %q", f.Name, got, want)
+        }
+        if other, ok := seen[got]; ok {
+            t.Errorf("flags %q and %q both map to key %q", other, f.Name, got)
+        }
+        seen[got] = f.Name
+    })
+    if len(seen) != len(keys) {
+        t.Errorf("%d flags registered, test table has %d", len(seen), len(keys))
+    }
+
+    if got := envName("serverIP"); got != "FTPCLIENT_SERVER_IP" {
+        t.Errorf("envName(serverIP) = %q, want FTPCLIENT_SERVER_IP", got)
+    }
+}
+
+func TestFlagKeyAcronyms(t *testing.T) {
+    tests := map[string]string{
+        "serverIP":     "server_ip",
+        "HTTPProxy":    "http_proxy",
+        "useHTTPProxy": "use_http_proxy",
+        "fileID2":      "file_id2",
+        "md5Sum":       "md5_sum",
+        "IP":           "ip",
+        "log-IP":       "log_ip",
+    }
+    for name, want := range tests {
+        if got := flagKey(name); got != want {
+            t.Errorf("flagKey(%q) = %q, want %q", name, got, want)
+        }
+    }
+}
@@ -2,7 +2,7 @@ package downloader
 
 import (
 	"FtpClient/common"
-	"crypto/md5"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
@@ -10,11 +10,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -23,77 +26,369 @@ import (
 type Downloader struct {
 	common.FileMetadata                 // 文件元数据
 	common.SliceSeq                     // 需要重传的序号
-	waitGoroutine   sync.WaitGroup  	// 同步goroutine
 	DownloadDir     string          	// 下载文件保存目录
-	RetryChannel	chan int			// 重传channel通道
-	MaxGtChannel	chan struct{}		// 限制上传的goroutine的数量通道
+	Concurrency		*common.Concurrency	// 限制同时下载的分片数量，开启自适应时会动态调整
 	StartTime		int64				// 下载开始时间
+	conf			*common.Config		// 客户端配置
+	partFile		*os.File			// 直接写入模式下预分配的临时目标文件
+	bitmapLock		sync.Mutex			// 保护分片位图及其持久化
+	transfer		*common.Transfer	// 在全局调度器中的登记
+	rateLimiter		*common.RateLimiter	// 这个文件的限速
+	retries			*common.RetryBudget	// 这次下载的重试预算
+	abort			context.CancelFunc	// 分片不能再重试时结束整个下载
+	slices			*common.SliceTracker // 这次下载中各个分片的状态
+	progress		*common.ProgressReporter // 这次下载的进度
 }
 
-// DownloadFile 单个文件的下载
-func DownloadFile(filename string, downloadDir string) (error){
+// 普通文件续传使用的校验信息，服务端文件变化后不能再续传
+type rangeValidator struct {
+	ETag			string		// 服务端返回的ETag
+	LastModified	string		// 服务端返回的Last-Modified
+}
+
+// 获取普通文件续传校验信息的保存路径
+func getDownloadResumeFile(filePath string) string {
+	paths, fileName := filepath.Split(filePath)
+	return path.Join(paths, "."+fileName+".resume")
+}
+
+// 读取续传校验信息，没有时返回nil
+func loadRangeValidator(filePath string) *rangeValidator {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil
+	}
+	var validator rangeValidator
+	if json.Unmarshal(data, &validator) != nil || (validator.ETag == "" && validator.LastModified == "") {
+		return nil
+	}
+	return &validator
+}
+
+// 解析Content-Range中的起始偏移，如bytes 100-199/200
+func contentRangeStart(contentRange string) (int64, error) {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, errors.New("invalid Content-Range: " + contentRange)
+	}
+	rangeSpec := strings.TrimPrefix(contentRange, "bytes ")
+	idx := strings.Index(rangeSpec, "-")
+	if idx < 0 {
+		return 0, errors.New("invalid Content-Range: " + contentRange)
+	}
+	return strconv.ParseInt(rangeSpec[:idx], 10, 64)
+}
+
+// DownloadFile 单个文件的下载，先写到临时文件，中断后再次下载时用Range请求从已下载的位置续传，
+// 通过ETag或Last-Modified确认服务端文件没有变化，下载完成后重命名为目标文件，失败时按重试策略续传
+func DownloadFile(ctx context.Context, conf *common.Config, filename string, downloadDir string) (error){
+	err := common.CheckPath("filename", filename)
+	if err != nil {
+		conf.Log().Error("download.unsafe_name", "err", err)
+		return err
+	}
 	if !common.IsDir(downloadDir) {
-		fmt.Printf("指定下载路径：%s 不存在\n", downloadDir)
-		return errors.New("指定下载路径不存在")
+		conf.Log().Error("download.dir_not_exist", "dir", downloadDir)
+		return errors.New("download directory does not exist")
 	}
 
-	targetUrl := common.BaseUrl + "download?filename=" + filename
-	req, _ := http.NewRequest("GET", targetUrl, nil)
-	resp, err := (&http.Client{}).Do(req)
+	// 普通文件大小事先不知道，得到响应后再设置
+	progress := common.NewProgressReporter(conf.Progress, "download", filename, "", 0, 0)
+
+	retries := common.NewRetryBudget(conf.Retry)
+	for {
+		err := downloadFileOnce(ctx, conf, filename, downloadDir, progress, retries)
+		if err == nil {
+			progress.Finish(nil)
+			return nil
+		}
+		delay, retryErr := retries.Next(0, err)
+		if retryErr != nil {
+			progress.Finish(retryErr)
+			return retryErr
+		}
+		conf.Log().Warn("download.retry", "file", filename, "delay", delay, "err", err)
+		progress.Retry()
+		err = common.Sleep(ctx, delay)
+		if err != nil {
+			progress.Finish(err)
+			return err
+		}
+	}
+}
+
+// 发起一次整个文件的下载，有临时文件时从断点处续传
+func downloadFileOnce(ctx context.Context, conf *common.Config, filename string, downloadDir string, progress *common.ProgressReporter, retries *common.RetryBudget) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// 请求发出后，取消时给它留出完成的时间
+	reqCtx, reqCancel := common.GraceContext(ctx, conf.GracePeriod)
+	defer reqCancel()
+
+	// 整个下载也占用一个全局的请求名额，普通文件大小事先不知道，按小文件对待
+	transfer := conf.Scheduler.Register(filename, 0)
+	defer transfer.Done()
+	err := transfer.Acquire(ctx)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
-	defer resp.Body.Close()
+	defer transfer.Release()
 
 	filePath := path.Join(downloadDir, filename)
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0666)
+	tmpPath := getDownloadPartFile(filePath)
+	resumePath := getDownloadResumeFile(filePath)
+
+	// 有上次未下载完的临时文件和校验信息时从断点处续传
+	var offset int64
+	validator := loadRangeValidator(resumePath)
+	if tmpStat, err := os.Stat(tmpPath); err == nil && validator != nil {
+		offset = tmpStat.Size()
+	}
+
+	targetUrl := conf.Url("download", url.Values{"filename": {filename}})
+	req, _ := http.NewRequestWithContext(reqCtx, "GET", targetUrl, nil)
+	if offset > 0 {
+		// 服务端文件变化时If-Range不匹配，会返回整个文件
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		if validator.ETag != "" {
+			req.Header.Set("If-Range", validator.ETag)
+		} else {
+			req.Header.Set("If-Range", validator.LastModified)
+		}
+		conf.Log().Info("download.resume_at", "file", filename, "offset", offset)
+	}
+	resp, err := conf.Do(req)
 	if err != nil {
-		fmt.Printf(err.Error())
+		conf.Log().Warn("download.request_failed", "file", filename, "err", err)
+		return common.NetworkError("download file", err)
+	}
+	defer resp.Body.Close()
+
+	// 续传失败时丢弃临时文件，重试时从头下载
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+	case http.StatusPartialContent:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			conf.Log().Warn("download.range_mismatch", "file", filename, "offset", offset)
+			os.Remove(tmpPath)
+			os.Remove(resumePath)
+			return &common.TransferError{Op: "download file", Retryable: true, Err: errors.New("resume offset mismatch")}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// 临时文件比服务端文件还大，说明文件已变化，丢弃后重新下载
+		conf.Log().Warn("download.part_stale", "file", filename)
+		os.Remove(tmpPath)
+		os.Remove(resumePath)
+		return &common.TransferError{Op: "download file", Retryable: true, Err: errors.New("partial file is stale")}
+	default:
+		conf.Log().Warn("download.request_failed", "file", filename, "status", resp.StatusCode)
+		return common.StatusError("download file", resp)
+	}
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		conf.Log().Error("download.create_failed", "path", tmpPath, "err", err)
 		return err
 	}
 	defer f.Close()
+	// 整个重新下载时截掉旧内容
+	err = f.Truncate(offset)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+
+	// 保存这次下载的校验信息，服务端没有给出时无法续传
+	validator = &rangeValidator{
+		ETag:			resp.Header.Get("ETag"),
+		LastModified:	resp.Header.Get("Last-Modified"),
+	}
+	if validator.ETag != "" || validator.LastModified != "" {
+		data, _ := json.Marshal(validator)
+		err = ioutil.WriteFile(resumePath, data, 0666)
+		if err != nil {
+			// 不影响这次下载，只是中断后不能续传，去掉可能残留的旧校验信息
+			conf.Log().Warn("download.resume_save_failed", "file", filename, "err", err)
+			os.Remove(resumePath)
+		}
+	} else {
+		os.Remove(resumePath)
+	}
 
-	_, err = io.Copy(f, resp.Body)
+	// 按全局和这个文件的限速接收
+	body := common.LimitReader(reqCtx, resp.Body, conf.DownloadRate, common.NewRateLimiter(conf.DownloadFileRate))
+	if resp.ContentLength >= 0 {
+		progress.SetTotal(offset + resp.ContentLength)
+	}
+	progress.Restart(offset)
+	_, err = io.Copy(f, &networkReader{r: retries.Reader(progress.Reader(body)), op: "download file"})
 	if err != nil {
+		// 只有读取响应时的网络错误可以重试，写本地文件失败直接返回
+		conf.Log().Warn("download.interrupted", "file", filename, "err", err)
 		return err
 	}
-	fmt.Printf("%s 文件下载成功，保存路径：%s\n", filename, filePath)
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	savePath, err := finalizeDownload(conf, tmpPath, filePath)
+	if err != nil {
+		conf.Log().Error("download.save_failed", "file", filename, "err", err)
+		return err
+	}
+	os.Remove(resumePath)
+	conf.Log().Info("download.done", "file", filename, "path", savePath)
 	return nil
 }
 
-// NewDownLoader 新建一个下载器
-func NewDownLoader(filename string, downloadDir string) (*Downloader) {
-	targetUrl := common.BaseUrl + "getFileMetainfo?filename=" + filename
+// 将下载完成并校验通过的临时文件落盘后移动到目标位置，返回最终的保存路径，
+// 目标文件已存在时按conf.OnExist处理，跳过时返回已有文件的路径
+func finalizeDownload(conf *common.Config, tmpPath string, targetPath string) (string, error) {
+	f, err := os.OpenFile(tmpPath, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return "", err
+	}
 
-	req, _ := http.NewRequest("GET", targetUrl, nil)
-	resp, err := (&http.Client{}).Do(req)
+	savePath := targetPath
+	switch conf.OnExist {
+	case common.OnExistSkip:
+		err = renameNoClobber(tmpPath, targetPath)
+		if os.IsExist(err) {
+			conf.Log().Info("download.kept_existing", "path", targetPath)
+			os.Remove(tmpPath)
+			return targetPath, nil
+		}
+	case common.OnExistRename:
+		// 依次尝试abc.pdf、abc (1).pdf、abc (2).pdf...
+		ext := filepath.Ext(targetPath)
+		base := strings.TrimSuffix(targetPath, ext)
+		for i := 1; ; i++ {
+			err = renameNoClobber(tmpPath, savePath)
+			if !os.IsExist(err) {
+				break
+			}
+			savePath = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+	default:
+		err = os.Rename(tmpPath, targetPath)
+	}
 	if err != nil {
-		fmt.Println(err)
-		return nil
+		return "", err
+	}
+
+	// 目录也落盘，保证重命名在掉电后仍然有效，部分系统不支持同步目录，忽略错误
+	if dir, err := os.Open(filepath.Dir(savePath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return savePath, nil
+}
+
+// 目标文件不存在时才重命名，存在时返回的错误满足os.IsExist。
+// 优先使用硬链接保证原子性，文件系统不支持硬链接时退化为先检查再重命名
+func renameNoClobber(oldPath string, newPath string) error {
+	err := os.Link(oldPath, newPath)
+	if err == nil {
+		return os.Remove(oldPath)
+	}
+	if os.IsExist(err) {
+		return err
+	}
+
+	if _, err := os.Lstat(newPath); err == nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrExist}
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// 检查元数据中的文件名和fid，它们会拼接到下载目录下，不能指向下载目录之外，文件名还必须与请求的一致
+func checkMetadataNames(metadata *common.FileMetadata, filename string) error {
+	err := common.CheckName("fid", metadata.Fid)
+	if err != nil {
+		return err
+	}
+	err = common.CheckPath("filename", metadata.Filename)
+	if err != nil {
+		return err
+	}
+	if metadata.Filename != filename {
+		return &common.UnsafeNameError{Field: "filename", Name: metadata.Filename}
+	}
+	return nil
+}
+
+// NewDownLoader 新建一个下载器，请求的文件名或服务端返回的元数据不安全时返回*common.UnsafeNameError
+func NewDownLoader(ctx context.Context, conf *common.Config, filename string, downloadDir string) (*Downloader, error) {
+	err := common.CheckPath("filename", filename)
+	if err != nil {
+		conf.Log().Error("download.unsafe_name", "err", err)
+		return nil, err
+	}
+
+	targetUrl := conf.Url("getFileMetainfo", url.Values{"filename": {filename}})
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", targetUrl, nil)
+	resp, err := conf.Do(req)
+	if err != nil {
+		conf.Log().Error("download.metainfo_failed", "file", filename, "err", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		conf.Log().Error("download.metainfo_failed", "file", filename, "status", resp.StatusCode)
+		return nil, errors.New("failed to get file metadata: " + resp.Status)
+	}
+
 	var metadata common.FileMetadata
 	err = json.NewDecoder(resp.Body).Decode(&metadata)
 	if err != nil {
-		fmt.Println("获取文件元数据失败")
-		return nil
+		conf.Log().Error("download.metainfo_failed", "file", filename, "err", err)
+		return nil, err
 	}
 
-	// 创建下载分片保存路径文件夹
-	dSliceDir := path.Join(downloadDir, metadata.Fid)
-	err = os.Mkdir(dSliceDir, 0766)
+	// 服务端返回的名称会拼接到下载目录下，先检查是否安全
+	err = checkMetadataNames(&metadata, filename)
 	if err != nil {
-		fmt.Println("创建下载分片目录失败", dSliceDir, err)
-		return nil
+		conf.Log().Error("download.unsafe_name", "err", err)
+		return nil, err
+	}
+
+	// 老服务端的元数据没有分片大小，无法计算偏移，只能使用分片目录
+	if conf.DirectWrite && metadata.SliceBytes > 0 {
+		// 预分配临时目标文件，分片直接写到对应偏移处，下载进度记录在位图中
+		partPath := getDownloadPartFile(path.Join(downloadDir, filename))
+		err = preallocate(partPath, metadata.Filesize)
+		if err != nil {
+			conf.Log().Error("download.preallocate_failed", "path", partPath, "err", err)
+			return nil, err
+		}
+		metadata.SliceBitmap = make([]byte, (metadata.SliceNum+7)/8)
+	} else {
+		// 创建下载分片保存路径文件夹
+		dSliceDir := path.Join(downloadDir, metadata.Fid)
+		err = os.Mkdir(dSliceDir, 0766)
+		if err != nil {
+			conf.Log().Error("download.mkdir_failed", "dir", dSliceDir, "err", err)
+			return nil, err
+		}
 	}
 
 	matadataPath := getDownloadMetaFile(path.Join(downloadDir, filename))
 	err = common.StoreMetadata(matadataPath, &metadata)
 	if err != nil {
-		fmt.Println("写元数据文件失败")
-		return nil
+		conf.Log().Error("meta.store_failed", "path", matadataPath, "err", err)
+		return nil, err
 	}
 
 	return &Downloader{
@@ -102,10 +397,10 @@ func NewDownLoader(filename string, downloadDir string) (*Downloader) {
 		SliceSeq:       	common.SliceSeq{
 			Slices: []int{-1},
 		},
-		RetryChannel: 		make(chan int, common.DownloadRetryChannelNum),
-		MaxGtChannel: 		make(chan struct{}, common.DpGoroutineMaxNumPerFile),
+		Concurrency: 		conf.NewConcurrency(conf.DpGoroutineMaxNum),
 		StartTime: 			time.Now().Unix(),
-	}
+		conf: 				conf,
+	}, nil
 }
 
 // 获取上传元数据文件路径
@@ -114,36 +409,80 @@ func getDownloadMetaFile(filePath string) string {
 	return path.Join(paths, "."+fileName+".downloading")
 }
 
-func GetDownLoader(filename string, downloadDir string) (*Downloader) {
+// 获取直接写入模式下临时目标文件路径，下载完成并校验通过后重命名为目标文件
+func getDownloadPartFile(filePath string) string {
+	paths, fileName := filepath.Split(filePath)
+	return path.Join(paths, "."+fileName+".part")
+}
+
+// 创建指定大小的文件，分片可以按偏移直接写入
+func preallocate(filePath string, size int64) error {
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if err != nil {
+		f.Close()
+		os.Remove(filePath)
+		return err
+	}
+	return f.Close()
+}
+
+// GetDownLoader 获取一个下载器，用以初始化之前未下载完的
+func GetDownLoader(ctx context.Context, conf *common.Config, filename string, downloadDir string) (*Downloader) {
 	downloadingFile := getDownloadMetaFile(path.Join(downloadDir, filename))
-	fmt.Println(downloadingFile)
 	if common.IsFile(downloadingFile) {
-		fmt.Printf("%s是还没下载完的文件", filename)
+		conf.Log().Info("download.unfinished", "file", filename, "meta", downloadingFile)
 		file, err := os.Open(downloadingFile)
 		if err != nil {
-			fmt.Println("获取文件状态失败")
+			conf.Log().Error("meta.open_failed", "path", downloadingFile, "err", err)
 			return nil
 		}
 
 		var metadata common.FileMetadata
 		filedata := gob.NewDecoder(file)
 		err = filedata.Decode(&metadata)
+		file.Close()
 		if err != nil {
-			fmt.Println("格式化文件数据失败")
+			conf.Log().Warn("meta.decode_failed", "path", downloadingFile, "err", err)
+			os.Remove(downloadingFile)
+			return nil
+		}
+
+		// 本地的元数据也可能来自之前不可信的服务端，名称不安全时重新向服务端获取
+		err = checkMetadataNames(&metadata, filename)
+		if err != nil {
+			conf.Log().Warn("download.unsafe_name", "err", err)
+			os.Remove(downloadingFile)
+			return nil
+		}
+
+		// 直接写入模式下临时目标文件丢失或大小不对时，位图记录的进度已不可信，重新下载
+		if metadata.SliceBitmap != nil {
+			partStat, err := os.Stat(getDownloadPartFile(path.Join(downloadDir, filename)))
+			if err != nil || partStat.Size() != metadata.Filesize {
+				conf.Log().Warn("download.part_stale", "file", filename)
+				os.Remove(downloadingFile)
+				return nil
+			}
 		}
 
 		dloader := &Downloader{
 			DownloadDir:    downloadDir,
 			FileMetadata:   metadata,
-			RetryChannel: 		make(chan int, common.DownloadRetryChannelNum),
-			MaxGtChannel: 	make(chan struct{}, common.DpGoroutineMaxNumPerFile),
+			Concurrency: 	conf.NewConcurrency(conf.DpGoroutineMaxNum),
 			StartTime: 		time.Now().Unix(),
+			conf: 			conf,
 		}
 
 		// 计算还需下载的分片
-		sliceseq, err := dloader.calNeededSlice()
+		sliceseq, err := dloader.calNeededSlice(ctx)
 		if err != nil {
-			os.Remove(downloadingFile)
+			if ctx.Err() == nil {
+				os.Remove(downloadingFile)
+			}
 			return nil
 		}
 		dloader.Slices = sliceseq.Slices
@@ -155,35 +494,49 @@ func GetDownLoader(filename string, downloadDir string) (*Downloader) {
 	return nil
 }
 
+// 带上文件ID和文件名的日志
+func (d *Downloader) log() *slog.Logger {
+	return d.conf.Log().With("fid", d.Fid, "file", d.Filename)
+}
+
 // 计算还需下载的分片序号
-func (d *Downloader) calNeededSlice() (*common.SliceSeq, error) {
+func (d *Downloader) calNeededSlice(ctx context.Context) (*common.SliceSeq, error) {
 	seq := common.SliceSeq{
 		Slices: []int{},
 	}
 	// 检查服务器端是否还存在这个文件
-	targetUrl := common.BaseUrl + "checkFileExist?fid=" + d.Fid + "&filename=" + d.Filename
+	targetUrl := d.conf.Url("checkFileExist", url.Values{"fid": {d.Fid}, "filename": {d.Filename}})
 
-	req, _ := http.NewRequest("GET", targetUrl, nil)
-	resp, err := (&http.Client{}).Do(req)
+	req, _ := http.NewRequestWithContext(ctx, "GET", targetUrl, nil)
+	resp, err := d.conf.Do(req)
 	if err != nil {
-		fmt.Println(err)
+		d.log().Warn("download.check_failed", "err", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 	// 判断状态码来判断是否检测成功
 	if resp.StatusCode != http.StatusOK {
-		fmt.Println("该文件在服务器端已不存在")
+		d.log().Warn("download.remote_gone", "status", resp.StatusCode)
 		os.Remove(path.Join(d.DownloadDir, d.Filename+".downloding"))
 		return nil, errors.New("invalid downloading file")
 	}
 
-	// 获取已保存的文件片序号
+	// 获取已保存的文件片序号，直接写入模式从位图中获取
 	storeSeq := make(map[string]bool)
+	for i := 0; d.SliceBitmap != nil && i < d.SliceNum; i++ {
+		if d.sliceDone(i) {
+			storeSeq[strconv.Itoa(i)] = true
+		}
+	}
 	files, _ := ioutil.ReadDir(path.Join(d.DownloadDir, d.Fid))
 	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".part") {
+			// 没下载完的分片，需要重新下载
+			continue
+		}
 		_, err := strconv.Atoi(file.Name())
 		if err != nil {
-			fmt.Println("文件片有错", err, file.Name())
+			d.log().Warn("slice.bad_file", "name", file.Name())
 			continue
 		}
 		storeSeq[file.Name()] = true
@@ -208,108 +561,338 @@ func (d *Downloader) calNeededSlice() (*common.SliceSeq, error) {
 		}
 	}
 
-	fmt.Printf("%s还需重新下载的片\n", d.Filename)
-	fmt.Println(seq.Slices)
+	d.log().Info("download.resume", "slices", seq.Slices)
 	return &seq, nil
 }
 
-// 重下载失败的分片
-func (d *Downloader) retryDownloadSlice() {
-	for sliceIndex := range d.RetryChannel {
-		// 检查下载是否超时了
-		if time.Now().Unix() - d.StartTime > common.DownloadTimeout {
-			fmt.Println("下载超时，请重试")
-			d.waitGoroutine.Done()
-		}
+// 分片下载失败，下载未被取消且还能重试时，分片回到等待状态，等待退避时间后重下载，否则标记为失败
+func (d *Downloader) retryLater(ctx context.Context, reqCtx context.Context, sliceIndex int, err error) {
+	if ctx.Err() != nil {
+		d.slices.Fail(sliceIndex)
+		return
+	}
 
-		fmt.Printf("重下载文件分片，文件名:%s, 分片序号:%d\n", d.Filename, sliceIndex)
-		go d.downloadSlice(sliceIndex)
+	// 不可重试的错误或重试次数用完时结束整个下载
+	delay, err := d.retries.Next(sliceIndex, err)
+	if err != nil {
+		d.log().Error("slice.give_up", "slice", sliceIndex, "err", err)
+		d.abort()
+		d.slices.Fail(sliceIndex)
+		return
 	}
+
+	// 退避等待期间不占用并发名额
+	d.slices.Retry(sliceIndex)
+	go func() {
+		if common.Sleep(ctx, delay) != nil {
+			d.slices.Fail(sliceIndex)
+			return
+		}
+		d.log().Info("slice.retry", "slice", sliceIndex, "delay", delay)
+		d.progress.Retry()
+		d.downloadSlice(ctx, reqCtx, sliceIndex)
+	}()
 }
 
-// 下载分片
-func (d *Downloader) downloadSlice(sliceIndex int) (error) {
-	d.MaxGtChannel <- struct{}{}
-	defer func (){
-		<-d.MaxGtChannel
+// 下载分片，先写到临时文件，写完后再重命名，避免中断时留下不完整的分片。
+// ctx取消后不再开始新的请求，已发出的请求使用reqCtx，可以在宽限时间内完成
+func (d *Downloader) downloadSlice(ctx context.Context, reqCtx context.Context, sliceIndex int) (error) {
+	err := d.Concurrency.Acquire(ctx)
+	if err != nil {
+		d.slices.Fail(sliceIndex)
+		return err
+	}
+	defer d.Concurrency.Release()
+
+	// 再获取全局的分片请求名额，所有文件共享
+	err = d.transfer.Acquire(ctx)
+	if err != nil {
+		d.slices.Fail(sliceIndex)
+		return err
+	}
+	defer d.transfer.Release()
+
+	// 分片已不在等待状态时不再下载，避免同一分片被重复下载
+	if !d.slices.Start(sliceIndex) {
+		return nil
+	}
+
+	// 记录分片的时延和结果，用于调整并发数，取消导致的失败不计入
+	start := time.Now()
+	sampleBytes := int64(d.SliceBytes)
+	failed := true
+	defer func() {
+		if !failed || reqCtx.Err() == nil {
+			d.Concurrency.Observe(common.SliceSample{Bytes: sampleBytes, Latency: time.Since(start), Err: failed})
+		}
 	}()
 
-	targetUrl := common.BaseUrl + "downloadBySlice?filename=" + d.Filename + "&sliceIndex=" + strconv.Itoa(sliceIndex)
-	req, _ := http.NewRequest("GET", targetUrl, nil)
-	resp, err := (&http.Client{}).Do(req)
+	targetUrl := d.conf.Url("downloadBySlice", url.Values{"filename": {d.Filename}, "sliceIndex": {strconv.Itoa(sliceIndex)}})
+	req, _ := http.NewRequestWithContext(reqCtx, "GET", targetUrl, nil)
+	resp, err := d.conf.Do(req)
 	if err != nil {
-		fmt.Println(err)
-		d.RetryChannel <- sliceIndex
+		err = common.NetworkError("download slice", err)
+		d.log().Warn("slice.download_failed", "slice", sliceIndex, "err", err)
+		d.retryLater(ctx, reqCtx, sliceIndex, err)
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.ContentLength > 0 {
+		sampleBytes = resp.ContentLength
+	}
 
 	if resp.StatusCode != http.StatusOK {
-		d.RetryChannel <- sliceIndex
-		errMsg, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
+		err := common.StatusError("download slice", resp)
+		d.log().Warn("slice.download_failed", "slice", sliceIndex, "err", err)
+		d.retryLater(ctx, reqCtx, sliceIndex, err)
+		return err
+	}
+
+	// 边写边计算校验值，与服务端给出的不一致时丢弃该分片重新下载
+	sliceHash := common.NewSliceHash()
+	limited := common.LimitReader(reqCtx, resp.Body, d.conf.DownloadRate, d.rateLimiter)
+	body := io.TeeReader(&networkReader{r: limited, op: "download slice"}, sliceHash)
+	verify := func() error {
+		checksum := resp.Header.Get(common.SliceChecksumHeader)
+		if checksum != "" && common.FormatSliceChecksum(sliceHash) != checksum {
+			return &common.TransferError{Op: "download slice", Retryable: true, Err: errors.New("slice checksum mismatch")}
 		}
-		return errors.New(string(errMsg))
+		return nil
 	}
 
-	filePath := path.Join(d.DownloadDir, d.Fid, strconv.Itoa(sliceIndex))
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0666)
+	if d.SliceBitmap != nil {
+		err = d.writeSliceAt(sliceIndex, body, verify)
+	} else {
+		err = d.writeSliceFile(sliceIndex, body, verify)
+	}
 	if err != nil {
-		fmt.Println(err)
-		d.RetryChannel <- sliceIndex
+		d.log().Warn("slice.write_failed", "slice", sliceIndex, "err", err)
+		// 读取响应时的网络错误和分片校验失败会重新下载，写本地文件失败如磁盘已满则不再重试
+		d.retryLater(ctx, reqCtx, sliceIndex, err)
 		return err
 	}
+	d.log().Debug("slice.downloaded", "slice", sliceIndex)
+	failed = false
+	d.retries.Progress()
+	if d.slices.Finish(sliceIndex) {
+		d.progress.SliceDone(d.sliceSize(sliceIndex))
+	}
+	return nil
+}
 
-	_, err = io.Copy(f, resp.Body)
+// 分片写到分片目录中，先写到临时文件，校验通过后再重命名
+func (d *Downloader) writeSliceFile(sliceIndex int, body io.Reader, verify func() error) error {
+	filePath := path.Join(d.DownloadDir, d.Fid, strconv.Itoa(sliceIndex))
+	tmpPath := filePath + ".part"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		fmt.Printf("文件%s的%d分片拷贝失败，失败原因:%s\n", d.Filename, sliceIndex, err.Error())
-		d.RetryChannel <- sliceIndex
 		return err
 	}
+
+	_, err = io.Copy(f, body)
 	f.Close()
-	//fmt.Printf("文件%s的%d分片下载成功, 写入字节数:%d\n", d.Filename, sliceIndex, writeByes)
-	d.waitGoroutine.Done()
-	return nil
+	if err == nil {
+		err = verify()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// 分片直接写到临时目标文件的对应偏移处，校验通过后在位图中标记完成。
+// 写到一半失败的分片位图中没有标记，会被重新下载覆盖
+func (d *Downloader) writeSliceAt(sliceIndex int, body io.Reader, verify func() error) error {
+	offset := int64(sliceIndex) * int64(d.SliceBytes)
+	size := d.sliceSize(sliceIndex)
+
+	// 最多只写一个分片的数据，避免覆盖相邻分片
+	n, err := io.Copy(&offsetWriter{f: d.partFile, offset: offset}, io.LimitReader(body, size))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return &common.TransferError{Op: "download slice", Retryable: true,
+			Err: fmt.Errorf("slice size mismatch, expected %d bytes, got %d", size, n)}
+	}
+	err = verify()
+	if err != nil {
+		return err
+	}
+	return d.markSliceDone(sliceIndex)
+}
+
+// 分片的大小，最后一个分片可能不足SliceBytes
+func (d *Downloader) sliceSize(sliceIndex int) int64 {
+	size := d.Filesize - int64(sliceIndex)*int64(d.SliceBytes)
+	if size > int64(d.SliceBytes) {
+		size = int64(d.SliceBytes)
+	}
+	return size
 }
 
-// DownloadFileBySlice 切片方式下载文件
-func (d *Downloader)DownloadFileBySlice() error {
-	// 启动重下载goroutine
-	go d.retryDownloadSlice()
+// networkReader 把读取响应体时的错误标记为网络错误，可以重试；
+// 写本地文件的错误不经过它，不会被当成可以重试的错误
+type networkReader struct {
+	r		io.Reader
+	op		string
+}
+
+func (r *networkReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = common.NetworkError(r.op, err)
+	}
+	return n, err
+}
+
+// 按偏移写文件，每次写入后偏移后移
+type offsetWriter struct {
+	f		*os.File
+	offset	int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// 分片是否已下载完成
+func (d *Downloader) sliceDone(sliceIndex int) bool {
+	return d.SliceBitmap[sliceIndex/8]&(1<<uint(sliceIndex%8)) != 0
+}
+
+// 在位图中标记分片下载完成，并保存到元数据文件中，中断后可以从位图恢复进度
+func (d *Downloader) markSliceDone(sliceIndex int) error {
+	d.bitmapLock.Lock()
+	defer d.bitmapLock.Unlock()
+	d.SliceBitmap[sliceIndex/8] |= 1 << uint(sliceIndex%8)
+	return common.StoreMetadata(getDownloadMetaFile(path.Join(d.DownloadDir, d.Filename)), &d.FileMetadata)
+}
+
+// DownloadFileBySlice 切片方式下载文件，ctx被取消后不再下载新的分片，
+// 等待已发出的分片结束后返回，已下载的分片和元数据文件会保留下来用于断点续传
+func (d *Downloader)DownloadFileBySlice(ctx context.Context) (err error) {
+	err = checkMetadataNames(&d.FileMetadata, d.Filename)
+	if err != nil {
+		d.conf.Log().Error("download.unsafe_name", "err", err)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d.progress = common.NewProgressReporter(d.conf.Progress, "download", d.Filename, d.Fid, d.Filesize, d.SliceNum)
+	defer func() {
+		d.progress.Finish(err)
+	}()
+
+	// 直接写入模式打开预分配的临时目标文件
+	if d.SliceBitmap != nil {
+		partFile, err := os.OpenFile(getDownloadPartFile(path.Join(d.DownloadDir, d.Filename)), os.O_WRONLY, 0666)
+		if err != nil {
+			d.log().Error("download.open_part_failed", "err", err)
+			return err
+		}
+		d.partFile = partFile
+		defer func() {
+			d.partFile.Close()
+			d.partFile = nil
+		}()
+	}
+
+	// 已发出的分片请求在取消后还可以在宽限时间内完成
+	reqCtx, reqCancel := common.GraceContext(ctx, d.conf.GracePeriod)
+	defer reqCancel()
+
+	// 这个文件的限速和重试预算，续传时重新开始计算
+	d.rateLimiter = common.NewRateLimiter(d.conf.DownloadFileRate)
+	d.retries = common.NewRetryBudget(d.conf.Retry)
+	d.abort = cancel
+
+	// 登记到全局调度器，与其他文件轮流获取分片请求名额
+	d.transfer = d.conf.Scheduler.Register(d.Filename, d.Filesize)
+	defer d.transfer.Done()
+	// 记录各个分片的状态，所有分片都完成或失败后结束
+	d.slices = common.NewSliceTracker()
 
 	metadata := &d.FileMetadata
-	for i :=0; i < metadata.SliceNum && len(d.Slices) > 0; i++ {
+	i := 0
+	for ; i < metadata.SliceNum && len(d.Slices) > 0 && ctx.Err() == nil; i++ {
 		if d.Slices[0] == -1 || i == d.Slices[0] {
 			if d.Slices[0] != -1 {
 				d.Slices = d.Slices[1:]
 			}
-			d.waitGoroutine.Add(1)
-			go d.downloadSlice(i)
+			d.slices.Add(i)
+			go d.downloadSlice(ctx, reqCtx, i)
+		} else {
+			// 之前已下载的分片
+			d.progress.Skip(1, d.sliceSize(i))
+		}
+	}
+	if len(d.Slices) == 0 {
+		// 后面的分片都已下载
+		for ; i < metadata.SliceNum; i++ {
+			d.progress.Skip(1, d.sliceSize(i))
 		}
 	}
 
 	// 等待各个分片都下载完成了
-	fmt.Printf("%s等待分片下载完成\n", d.Filename)
-	d.waitGoroutine.Wait()
-	fmt.Printf("%s分片都已下载完成\n", d.Filename)
+	d.log().Debug("slice.wait")
+	d.slices.Wait()
+	if err := d.retries.Err(); err != nil {
+		// 服务端拒绝了分片或重试次数用完，保存进度，问题解决后可以续传
+		common.StoreMetadata(getDownloadMetaFile(path.Join(d.DownloadDir, d.Filename)), &d.FileMetadata)
+		d.log().Error("download.failed_saved", "err", err)
+		return err
+	}
+	if ctx.Err() != nil {
+		// 保存断点续传需要的元数据，已下载完的分片在分片目录或位图中
+		common.StoreMetadata(getDownloadMetaFile(path.Join(d.DownloadDir, d.Filename)), &d.FileMetadata)
+		d.log().Warn("download.cancelled", "err", ctx.Err())
+		return ctx.Err()
+	}
+	d.log().Debug("slice.all_done")
 	return nil
 }
 
-// MergeDownloadFiles 合并分片文件为一个文件
+// MergeDownloadFiles 合并分片文件为一个文件，先合并到隐藏的临时文件中，校验通过后才移动到目标位置，
+// 直接写入模式下只需校验临时目标文件
 func (d *Downloader) MergeDownloadFiles() error {
-	fmt.Println("开始合并文件", d.Filename)
+	err := checkMetadataNames(&d.FileMetadata, d.Filename)
+	if err != nil {
+		d.conf.Log().Error("download.unsafe_name", "err", err)
+		return err
+	}
+
+	if d.SliceBitmap != nil {
+		return d.finishDirectWrite()
+	}
+
+	d.log().Info("download.merge")
 	targetFile := path.Join(d.DownloadDir, d.Filename)
-	f, err := os.OpenFile(targetFile, os.O_WRONLY|os.O_CREATE, 0666)
+	tmpPath := getDownloadPartFile(targetFile)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		fmt.Println(err)
+		d.log().Error("download.create_failed", "path", tmpPath, "err", err)
 		return err
 	}
+	defer f.Close()
 
 	sliceDir := path.Join(d.DownloadDir, d.Fid)
 
-	// 计算md5值，这里要注意，一定要按分片顺序计算，不要使用读目录文件的方式，返回的文件顺序是无保证的
-	md5hash := md5.New()
+	// 计算校验值，这里要注意，一定要按分片顺序计算，不要使用读目录文件的方式，返回的文件顺序是无保证的
+	algo, hashsum := d.Digest()
+	hashAlgo, err := common.GetHashAlgo(algo)
+	if err != nil {
+		d.log().Error("hash.unsupported", "algo", algo, "err", err)
+		return err
+	}
+	fileHash := hashAlgo.New()
 
 	defer os.Remove(getDownloadMetaFile(targetFile))
 	defer os.RemoveAll(sliceDir)
@@ -318,26 +901,96 @@ func (d *Downloader) MergeDownloadFiles() error {
 		sliceFilePath := path.Join(sliceDir, strconv.Itoa(i))
 		sliceFile, err := os.Open(sliceFilePath)
 		if err != nil {
-			fmt.Printf("读取文件%s失败, err: %s\n", sliceFilePath, err)
+			d.log().Error("download.read_slice_failed", "path", sliceFilePath, "err", err)
 			return err
 		}
-		io.Copy(md5hash, sliceFile)
+		_, err = io.Copy(fileHash, sliceFile)
 
 		// 偏移量需要重新进行调整
-		sliceFile.Seek(0, 0)
-		io.Copy(f, sliceFile)
+		if err == nil {
+			_, err = sliceFile.Seek(0, 0)
+		}
+		if err == nil {
+			_, err = io.Copy(f, sliceFile)
+		}
 
 		sliceFile.Close()
+		if err != nil {
+			d.log().Error("download.merge_failed", "path", sliceFilePath, "err", err)
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// 校验文件，校验失败的文件不会出现在目标位置
+	calHashsum := hex.EncodeToString(fileHash.Sum(nil))
+	if calHashsum != hashsum {
+		d.log().Error("download.hash_mismatch", "algo", algo, "expected", hashsum, "actual", calHashsum)
+		os.Remove(tmpPath)
+		return errors.New("file checksum mismatch")
+	}
+
+	savePath, err := finalizeDownload(d.conf, tmpPath, targetFile)
+	if err != nil {
+		d.log().Error("download.save_failed", "err", err)
+		os.Remove(tmpPath)
+		return err
+	}
+	d.log().Info("download.done", "path", savePath)
+
+	return nil
+}
+
+// 直接写入模式下完成下载，按顺序读一遍临时目标文件计算校验值，校验通过后重命名为目标文件
+func (d *Downloader) finishDirectWrite() error {
+	for i := 0; i < d.SliceNum; i++ {
+		if !d.sliceDone(i) {
+			d.log().Error("slice.not_downloaded", "slice", i)
+			return errors.New("slice not downloaded")
+		}
 	}
 
-	// 校验md5值
-	calMd5 := hex.EncodeToString(md5hash.Sum(nil))
-	if calMd5 != d.Md5sum {
-		fmt.Printf("%s文件校验失败，请重新下载, 原始md5: %s, 计算的md5: %s\n", d.Filename, d.Md5sum, calMd5)
-		return errors.New("文件校验失败")
+	targetFile := path.Join(d.DownloadDir, d.Filename)
+	partPath := getDownloadPartFile(targetFile)
+	algo, hashsum := d.Digest()
+	hashAlgo, err := common.GetHashAlgo(algo)
+	if err != nil {
+		d.log().Error("hash.unsupported", "algo", algo, "err", err)
+		return err
+	}
+
+	f, err := os.Open(partPath)
+	if err != nil {
+		d.log().Error("download.open_part_failed", "path", partPath, "err", err)
+		return err
 	}
+	fileHash := hashAlgo.New()
+	_, err = io.Copy(fileHash, f)
 	f.Close()
-	fmt.Printf("%s文件下载成功，保存路径：%s\n", d.Filename, targetFile)
+	if err != nil {
+		return err
+	}
+
+	// 校验失败时内容已不可信，丢弃进度重新下载
+	calHashsum := hex.EncodeToString(fileHash.Sum(nil))
+	if calHashsum != hashsum {
+		d.log().Error("download.hash_mismatch", "algo", algo, "expected", hashsum, "actual", calHashsum)
+		os.Remove(partPath)
+		os.Remove(getDownloadMetaFile(targetFile))
+		return errors.New("file checksum mismatch")
+	}
 
+	savePath, err := finalizeDownload(d.conf, partPath, targetFile)
+	if err != nil {
+		d.log().Error("download.save_failed", "err", err)
+		return err
+	}
+	os.Remove(getDownloadMetaFile(targetFile))
+	d.log().Info("download.done", "path", savePath)
 	return nil
 }
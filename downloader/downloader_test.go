@@ -0,0 +1,235 @@
+package downloader
+
+import (
+	"FtpClient/common"
+	"FtpClient/internal/testserver"
+	"FtpClient/uploader"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// 切片上传size字节的随机内容到服务端，返回上传的内容
+func uploadRandomFile(t *testing.T, conf *common.Config, filename string, size int) []byte {
+	filePath, data := testserver.WriteRandomFile(t, size)
+	uloader := uploader.NewUploader(conf, filePath, filename)
+	if uloader == nil {
+		t.Fatal("NewUploader returned nil")
+	}
+	err := uloader.UploadFileBySlice(context.Background())
+	if err != nil {
+		t.Fatalf("UploadFileBySlice: %v", err)
+	}
+	return data
+}
+
+// 切片下载filename到downloadDir并合并
+func downloadBySlice(ctx context.Context, conf *common.Config, filename string, downloadDir string) error {
+	dloader, err := NewDownLoader(ctx, conf, filename, downloadDir)
+	if err != nil {
+		return err
+	}
+	err = dloader.DownloadFileBySlice(ctx)
+	if err != nil {
+		return err
+	}
+	return dloader.MergeDownloadFiles()
+}
+
+func TestDownloadFileBySliceRetriesFaults(t *testing.T) {
+	for _, directWrite := range []bool{false, true} {
+		name := "slices"
+		if directWrite {
+			name = "directWrite"
+		}
+		t.Run(name, func(t *testing.T) {
+			f := &testserver.Faults{}
+			ts, _ := testserver.New(t, f)
+			conf := testserver.Config(ts)
+			conf.DirectWrite = directWrite
+			data := uploadRandomFile(t, conf, "big.bin", 10*conf.SliceBytes+123)
+
+			f.Set("/downloadBySlice", 3, 3)
+
+			downloadDir := t.TempDir()
+			err := downloadBySlice(context.Background(), conf, "big.bin", downloadDir)
+			if err != nil {
+				t.Fatalf("download: %v", err)
+			}
+			if f.Left() != 0 {
+				t.Fatalf("%d faults were not injected", f.Left())
+			}
+			got, err := os.ReadFile(filepath.Join(downloadDir, "big.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("downloaded file differs from source: got %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestDownloadFileBySliceBudgetExhausted(t *testing.T) {
+	f := &testserver.Faults{}
+	ts, _ := testserver.New(t, f)
+	conf := testserver.Config(ts)
+	conf.Retry.MaxTransferRetries = 5
+	uploadRandomFile(t, conf, "big.bin", 4*conf.SliceBytes)
+
+	f.Set("/downloadBySlice", 0, 1<<30)
+
+	downloadDir := t.TempDir()
+	err := downloadBySlice(context.Background(), conf, "big.bin", downloadDir)
+	if !errors.Is(err, common.ErrRetryBudgetExhausted) {
+		t.Fatalf("download error = %v, want ErrRetryBudgetExhausted", err)
+	}
+	if common.IsFile(filepath.Join(downloadDir, "big.bin")) {
+		t.Error("corrupted download was moved to the target path")
+	}
+}
+
+// 列出root下的所有文件和目录，相对路径
+func listTree(t *testing.T, root string) []string {
+	var names []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root {
+			rel, _ := filepath.Rel(root, p)
+			names = append(names, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestNewDownLoaderRejectsUnsafeMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		fid      string
+		filename string
+	}{
+		{"fid escapes", "../x", "big.bin"},
+		{"absolute fid", "/tmp/x", "big.bin"},
+		{"fid with separator", "a/../../x", "big.bin"},
+		{"filename mismatch", "0123", "other.bin"},
+		{"filename escapes", "0123", "../../big.bin"},
+		{"both unsafe", "../x", "../x"},
+	}
+	for _, tt := range tests {
+		for _, directWrite := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/directWrite=%v", tt.name, directWrite), func(t *testing.T) {
+				// 不可信的服务端，getFileMetainfo返回的名称会指向下载目录之外
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path != "/getFileMetainfo" {
+						t.Errorf("unexpected request %s", r.URL.Path)
+						http.NotFound(w, r)
+						return
+					}
+					json.NewEncoder(w).Encode(common.FileMetadata{
+						Fid:        tt.fid,
+						Filename:   tt.filename,
+						Filesize:   4 * 1024,
+						SliceNum:   4,
+						SliceBytes: 1024,
+					})
+				}))
+				defer ts.Close()
+				conf := testserver.Config(ts)
+				conf.DirectWrite = directWrite
+
+				root := t.TempDir()
+				downloadDir := filepath.Join(root, "a", "dl")
+				err := os.MkdirAll(downloadDir, 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				dloader, err := NewDownLoader(context.Background(), conf, "big.bin", downloadDir)
+				if !errors.Is(err, common.ErrUnsafeName) {
+					t.Fatalf("NewDownLoader error = %v, want ErrUnsafeName", err)
+				}
+				if dloader != nil {
+					t.Error("NewDownLoader returned a downloader for unsafe metadata")
+				}
+				// 下载目录内外都不应创建任何文件
+				got := listTree(t, root)
+				want := []string{"a", filepath.Join("a", "dl")}
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("files under %s = %v, want %v", root, got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestDownloadFileBySliceLocalWriteErrorNotRetried(t *testing.T) {
+	f := &testserver.Faults{}
+	ts, _ := testserver.New(t, f)
+	conf := testserver.Config(ts)
+	uploadRandomFile(t, conf, "big.bin", 4*conf.SliceBytes)
+
+	downloadDir := t.TempDir()
+	dloader, err := NewDownLoader(context.Background(), conf, "big.bin", downloadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 分片的临时文件位置被目录占用，写本地文件失败
+	err = os.MkdirAll(filepath.Join(downloadDir, dloader.Fid, "0.part"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dloader.DownloadFileBySlice(context.Background())
+	if !errors.Is(err, syscall.EISDIR) {
+		t.Fatalf("download error = %v, want EISDIR", err)
+	}
+	if common.IsRetryable(err) || errors.Is(err, common.ErrRetryBudgetExhausted) {
+		t.Fatalf("local write error %v was retried", err)
+	}
+}
+
+func TestDownloadFileResumeSaveFailed(t *testing.T) {
+	ts, _ := testserver.New(t, &testserver.Faults{})
+	conf := testserver.Config(ts)
+	var logs bytes.Buffer
+	conf.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	data := uploadRandomFile(t, conf, "small.bin", 1000)
+
+	// 续传信息文件的位置被目录占用，无法保存
+	downloadDir := t.TempDir()
+	err := os.Mkdir(getDownloadResumeFile(filepath.Join(downloadDir, "small.bin")), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = DownloadFile(context.Background(), conf, "small.bin", downloadDir)
+	if err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(downloadDir, "small.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("downloaded file differs from source: got %d bytes, want %d", len(got), len(data))
+	}
+	if !strings.Contains(logs.String(), "download.resume_save_failed") {
+		t.Errorf("failure to save resume info was not logged:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+    "FtpClient/common"
+    "bufio"
+    "bytes"
+    "context"
+    "errors"
+    "flag"
+    "io"
+    "io/fs"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// 要传输的文件可以通过以下方式指定，文件名中可以有空格等任意字符：
+//   1. 重复指定--uploadFilepaths或--downloadFilenames，每次一个文件
+//   2. 参数之后的位置参数，每个参数一个文件
+//   3. @listfile，从listfile中每行读取一个文件，@-从标准输入读取；文件名本身以@开头时写成@@
+//   4. -0，从标准输入读取以NUL分隔的文件名，可以配合find -print0使用
+
+// fileList 可重复指定的文件参数，每次指定添加一个文件
+type fileList []string
+
+func (l *fileList) String() string {
+    return strings.Join(*l, ", ")
+}
+
+func (l *fileList) Set(value string) error {
+    *l = append(*l, value)
+    return nil
+}
+
+// 从r中读取文件名，sep为分隔符，换行分隔时去掉行尾的\r，忽略空的文件名
+func readFileList(r io.Reader, sep byte) ([]string, error) {
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+    scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+        if i := bytes.IndexByte(data, sep); i >= 0 {
+            return i + 1, data[:i], nil
+        }
+        if atEOF && len(data) > 0 {
+            return len(data), data, nil
+        }
+        return 0, nil, nil
+    })
+
+    var names []string
+    for scanner.Scan() {
+        name := scanner.Text()
+        if sep == '\n' {
+            name = strings.TrimSuffix(name, "\r")
+        }
+        if name != "" {
+            names = append(names, name)
+        }
+    }
+    return names, scanner.Err()
+}
+
+// 读取@listfile中的文件名，@-表示从标准输入读取
+func readListFile(path string) ([]string, error) {
+    if path == "-" {
+        return readFileList(os.Stdin, '\n')
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    return readFileList(f, '\n')
+}
+
+// 汇总参数、位置参数、@listfile和标准输入中指定的文件
+func transferFiles(list fileList) ([]string, error) {
+    var files []string
+    for _, arg := range append(list, flag.Args()...) {
+        switch {
+        case strings.HasPrefix(arg, "@@"):
+            files = append(files, arg[1:])
+        case strings.HasPrefix(arg, "@"):
+            names, err := readListFile(arg[1:])
+            if err != nil {
+                return nil, err
+            }
+            files = append(files, names...)
+        default:
+            files = append(files, arg)
+        }
+    }
+
+    if *nulStdin {
+        names, err := readFileList(os.Stdin, 0)
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, names...)
+    }
+
+    if len(files) == 0 {
+        return nil, errors.New("no files to transfer")
+    }
+    return files, nil
+}
+
+// uploadTask 一个要上传的本地文件，name为服务端保存的文件名，是以/分隔的相对路径
+type uploadTask struct {
+    path string
+    name string
+    skip string // 不上传的原因，为空时上传
+}
+
+// filterFlag 可重复指定的过滤规则参数，--include、--exclude和--exclude-from按在命令行中的顺序添加到同一个Filter
+type filterFlag struct {
+    filter *common.Filter
+    kind   string // include、exclude或exclude-from
+    values []string
+}
+
+func (f *filterFlag) String() string {
+    if f == nil {
+        return ""
+    }
+    return strings.Join(f.values, ", ")
+}
+
+func (f *filterFlag) Set(value string) error {
+    f.values = append(f.values, value)
+    switch f.kind {
+    case "include":
+        return f.filter.Include(value)
+    case "exclude":
+        return f.filter.Exclude(value)
+    default:
+        file, err := os.Open(value)
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        return f.filter.ReadRules(file)
+    }
+}
+
+// 解析修改时间参数，可以是距现在的时长，如36h、7d，也可以是日期或时间，如2026-01-02、2026-01-02T15:04:05+08:00
+func parseTimeFlag(value string) (time.Time, error) {
+    if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && strings.HasSuffix(value, "d") {
+        return time.Now().AddDate(0, 0, -days), nil
+    }
+    if d, err := time.ParseDuration(value); err == nil {
+        return time.Now().Add(-d), nil
+    }
+    for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+        if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+            return t, nil
+        }
+    }
+    return time.Time{}, errors.New("cannot parse time: " + value)
+}
+
+// 判断文件是否通过过滤条件，relPath为匹配规则使用的相对路径，被过滤掉的文件输出调试日志
+func filterMatch(filter *common.Filter, relPath string, size int64, modTime time.Time) bool {
+    if filter.Match(relPath, size, modTime) {
+        return true
+    }
+    common.Logger().Debug("cli.filtered", "file", relPath)
+    return false
+}
+
+// 判断本地文件是否通过过滤条件，获取不到文件信息或不是普通文件时交给上传时报错
+func filterLocal(filter *common.Filter, relPath string, filePath string) bool {
+    stat, err := os.Stat(filePath)
+    if err != nil || stat.IsDir() {
+        return true
+    }
+    return filterMatch(filter, relPath, stat.Size(), stat.ModTime())
+}
+
+// 在上传结果中记录服务端保存的文件名
+func (t uploadTask) result(result transferResult) transferResult {
+    if filepath.ToSlash(t.path) != t.name {
+        result.Target = t.name
+    }
+    return result
+}
+
+// 跳过的文件的上传结果
+func (t uploadTask) skipped() transferResult {
+    common.Logger().Info("upload.skipped", "path", t.path, "reason", t.skip)
+    return t.result(transferResult{File: t.path, Action: "upload", Status: statusSkipped, Reason: t.skip})
+}
+
+// 展开要上传的文件，不递归时每个文件以基本名保存。
+// 递归时上传目录下的所有文件，包括隐藏的文件和目录，dir保存为dir/...，以/结尾的dir/只上传目录中的内容，不带目录名；
+// 断点续传的状态文件不上传，在结果中记为跳过。过滤规则按文件在目录下的相对路径匹配，不递归时按基本名匹配
+func uploadTasks(files []string, recursive bool, filter *common.Filter) ([]uploadTask, error) {
+    var tasks []uploadTask
+    for _, file := range files {
+        if !recursive || !common.IsDir(file) {
+            if filterLocal(filter, filepath.Base(file), file) {
+                tasks = append(tasks, uploadTask{path: file, name: filepath.Base(file)})
+            }
+            continue
+        }
+
+        prefix := ""
+        if !strings.HasSuffix(file, string(filepath.Separator)) && !strings.HasSuffix(file, "/") {
+            abs, err := filepath.Abs(file)
+            if err != nil {
+                return nil, err
+            }
+            if base := filepath.Base(abs); common.CheckName("dir", base) == nil {
+                prefix = base + "/"
+            }
+        }
+
+        err := filepath.WalkDir(file, func(filePath string, entry fs.DirEntry, err error) error {
+            if err != nil {
+                return err
+            }
+            if filePath == file {
+                return nil
+            }
+            rel, err := filepath.Rel(file, filePath)
+            if err != nil {
+                return err
+            }
+            rel = filepath.ToSlash(rel)
+            if entry.IsDir() {
+                if filter.Excluded(rel, true) {
+                    common.Logger().Debug("cli.filtered", "file", rel+"/")
+                    return filepath.SkipDir
+                }
+                return nil
+            }
+            if !filterLocal(filter, rel, filePath) {
+                return nil
+            }
+            task := uploadTask{path: filePath, name: prefix + rel}
+            if common.IsTransferStateFile(entry.Name()) {
+                task.skip = common.Translate(*logLang, "cli.skip_state_file")
+            }
+            tasks = append(tasks, task)
+            return nil
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+    return tasks, nil
+}
+
+// downloadTask 一个要下载的服务端文件，err不为空时不下载，在结果中记为失败
+type downloadTask struct {
+    name string
+    err  error
+}
+
+// 不能下载的文件的结果
+func (t downloadTask) failed() transferResult {
+    common.Logger().Error("download.failed", "file", t.name, "err", t.err)
+    return newTransferResult(t.name, "download", 0, time.Now(), t.err)
+}
+
+// 判断服务端的文件是否匹配名称，返回过滤规则使用的相对路径。
+// 名称可以是glob模式，如*.log、reports/2026-*，按MatchPath匹配整个相对路径；
+// 递归时名称匹配文件所在的某一级目录也算匹配，相对路径为该目录下的路径，.表示服务端的所有文件
+func matchRemote(pattern string, filename string, recursive bool) (string, bool) {
+    if pattern == filename || (common.HasMeta(pattern) && common.MatchPath(pattern, filename)) {
+        return path.Base(filename), true
+    }
+    if !recursive {
+        return "", false
+    }
+
+    dir := strings.Trim(pattern, "/")
+    if dir == "" || dir == "." {
+        return filename, true
+    }
+    elems := strings.Split(filename, "/")
+    for i := 1; i < len(elems); i++ {
+        prefix := strings.Join(elems[:i], "/")
+        if prefix == dir || (common.HasMeta(dir) && common.MatchPath(dir, prefix)) {
+            return strings.Join(elems[i:], "/"), true
+        }
+    }
+    return "", false
+}
+
+// 展开要下载的文件，名称可以是glob模式，递归时每个名称作为服务端的目录，下载其中的所有文件，
+// 本地保存在下载路径下的同名相对路径中。服务端有与名称完全相同的文件时不再作为模式匹配，
+// 没有匹配的文件时，不是模式的名称按文件名下载，模式在结果中记为失败。
+// 过滤规则按文件在目录下的相对路径匹配，不递归时按基本名匹配，服务端列表中没有的文件不过滤
+func downloadTasks(ctx context.Context, files []string, recursive bool, filter *common.Filter) ([]downloadTask, error) {
+    hasPattern := false
+    for _, file := range files {
+        hasPattern = hasPattern || common.HasMeta(file)
+    }
+    if !recursive && !hasPattern && filter.Empty() {
+        tasks := make([]downloadTask, len(files))
+        for i, file := range files {
+            tasks[i] = downloadTask{name: file}
+        }
+        return tasks, nil
+    }
+
+    fileinfos, err := ftpClient.List(ctx)
+    if err != nil {
+        return nil, err
+    }
+    exists := make(map[string]bool)
+    for _, info := range fileinfos.Files {
+        exists[info.Filename] = true
+    }
+
+    // 多个名称匹配到同一个文件时只下载一次
+    var tasks []downloadTask
+    seen := make(map[string]bool)
+    add := func(name string) {
+        if !seen[name] {
+            seen[name] = true
+            tasks = append(tasks, downloadTask{name: name})
+        }
+    }
+    for _, file := range files {
+        matched := false
+        for _, info := range fileinfos.Files {
+            var rel string
+            var ok bool
+            if exists[file] {
+                rel, ok = path.Base(file), info.Filename == file
+            } else {
+                rel, ok = matchRemote(file, info.Filename, recursive)
+            }
+            if !ok {
+                continue
+            }
+            matched = true
+            if filterMatch(filter, rel, info.Filesize, info.ModifyTime) {
+                add(info.Filename)
+            }
+        }
+        if !matched && common.HasMeta(file) {
+            tasks = append(tasks, downloadTask{name: file, err: errors.New("no files match pattern " + file)})
+        } else if !matched {
+            add(file)
+        }
+    }
+    return tasks, nil
+}
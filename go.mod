@@ -1,5 +1,11 @@
 module FtpClient
 
-go 1.16
+go 1.21
 
-require github.com/google/uuid v1.2.0
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/google/uuid v1.2.0
+	lukechampine.com/blake3 v1.1.7
+)
+
+require github.com/klauspost/cpuid/v2 v2.0.9 // indirect
@@ -0,0 +1,136 @@
+// Package testserver 提供上传和下载测试共用的注入故障的服务端和测试配置
+package testserver
+
+import (
+	"FtpClient/common"
+	"FtpClient/server"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Faults 按顺序向某个接口的请求注入故障，先返回ServerErrors次503，再损坏Corruptions次传输的数据。
+// 损坏数据时请求体和响应体的第一个字节都被翻转，上传接口损坏的是请求体，下载接口损坏的是响应体
+type Faults struct {
+	lock         sync.Mutex
+	Path         string
+	ServerErrors int
+	Corruptions  int
+}
+
+// Set 重新设置要注入的故障，服务端已在处理请求时使用
+func (f *Faults) Set(path string, serverErrors int, corruptions int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.Path, f.ServerErrors, f.Corruptions = path, serverErrors, corruptions
+}
+
+// 取出下一个请求要注入的故障
+func (f *Faults) take(path string) (serverError bool, corrupt bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if path != f.Path {
+		return false, false
+	}
+	if f.ServerErrors > 0 {
+		f.ServerErrors--
+		return true, false
+	}
+	if f.Corruptions > 0 {
+		f.Corruptions--
+		return false, true
+	}
+	return false, false
+}
+
+// Left 还没有注入的故障数
+func (f *Faults) Left() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.ServerErrors + f.Corruptions
+}
+
+// 翻转读到的第一个字节，模拟请求数据在传输中损坏
+type corruptBody struct {
+	io.ReadCloser
+	done bool
+}
+
+func (b *corruptBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.done {
+		p[0] ^= 0xff
+		b.done = true
+	}
+	return n, err
+}
+
+// 翻转写出的第一个字节，模拟响应数据在传输中损坏
+type corruptWriter struct {
+	http.ResponseWriter
+	done bool
+}
+
+func (w *corruptWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 && !w.done {
+		p = append([]byte(nil), p...)
+		p[0] ^= 0xff
+		w.done = true
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// New 启动注入故障的测试服务端，测试结束时关闭，返回服务端的保存目录
+func New(t testing.TB, f *Faults) (*httptest.Server, string) {
+	storeDir := t.TempDir()
+	srv, err := server.NewServer(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := srv.Handler()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverError, corrupt := f.take(r.URL.Path)
+		if serverError {
+			http.Error(w, "injected failure", http.StatusServiceUnavailable)
+			return
+		}
+		if corrupt {
+			r.Body = &corruptBody{ReadCloser: r.Body}
+			w = &corruptWriter{ResponseWriter: w}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, storeDir
+}
+
+// Config 测试用的配置，小分片、快速重试、独立的调度器
+func Config(ts *httptest.Server) *common.Config {
+	conf := common.NewConfig(ts.URL + "/")
+	conf.SliceBytes = 16 * 1024
+	conf.SliceFormat = common.SliceFormatBinary
+	conf.Scheduler = common.NewScheduler(4)
+	conf.Retry.BaseDelay = time.Millisecond
+	conf.Retry.MaxDelay = 10 * time.Millisecond
+	conf.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return conf
+}
+
+// WriteRandomFile 生成size字节的随机内容的本地文件，返回文件路径和内容
+func WriteRandomFile(t testing.TB, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	filePath := filepath.Join(t.TempDir(), "src.bin")
+	err := os.WriteFile(filePath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filePath, data
+}
@@ -1,204 +1,629 @@
 // 用法展示
 // 上传文件示例：go run main.go --action upload --uploadFilepaths /Users/haixian.luo/test/FtpData/data/abc.pdf
+// 上传多个文件示例：go run main.go --action upload "my report.pdf" abc.pdf，或find . -type f -print0 | go run main.go --action upload -0
+// 递归上传目录示例：go run main.go --action upload -r build，服务端保存为build/...，下载时go run main.go --action download -r build
+// 过滤文件示例：go run main.go --action upload -r --exclude '*.tmp' --exclude .git/ --max-size 1G build
 // 下载文件示例：go run main.go --action download --downloadDir /Users/haixian.luo/test/FtpData/download --downloadFilenames abc.pdf
-// 列出文件示例：go run main.go --action list
+// 列出文件示例：go run main.go --action list，只列出匹配的文件：go run main.go --action list 'reports/2026-*'
+// 按模式下载示例：go run main.go --action download '*.log'，加上--dry-run只列出会下载的文件
+// 启动服务示例：go run main.go --action serve --serverIP 0.0.0.0 --serverPort 800 --storeDir ./store
+// 上传下载结束后输出每个文件的结果，--output json时每个文件输出一行json记录；
+// 全部成功时退出码为0，全部失败为1，部分失败为2
+// 日志输出到标准错误，通过--log-level、--log-format、--quiet和--lang控制级别、格式和语言
+// 传输进度也输出到标准错误，终端上显示进度条，否则定时输出进度行，见--progress
+// 参数也可以通过FTPCLIENT_开头的环境变量或配置文件中的profile设置，优先级见config.go
 
 package main
 
 import (
+    "FtpClient/client"
     "FtpClient/common"
-    "FtpClient/downloader"
-    "FtpClient/uploader"
+    "FtpClient/server"
+    "context"
     "encoding/json"
+    "errors"
     "flag"
     "fmt"
-    "net/http"
+    "io"
+    "log/slog"
     "os"
+    "os/signal"
+    "path/filepath"
     "strings"
     "sync"
+    "syscall"
     "time"
 )
 
+func init() {
+    flag.Var(&uploadFilepaths, "uploadFilepaths", "上传文件路径，可以重复指定，每次一个文件，也可以写成@listfile从文件中每行读取一个")
+    flag.Var(&downloadFilenames, "downloadFilenames", "下载文件名，可以重复指定，格式同uploadFilepaths")
+    flag.Var(&filterFlag{filter: transferFilter, kind: "include"}, "include", "重新包含被exclude排除的文件，同.gitignore中以!开头的规则，可以重复指定，与exclude按顺序由最后一条匹配的规则决定")
+    flag.Var(&filterFlag{filter: transferFilter, kind: "exclude"}, "exclude", "不传输匹配的文件，如*.tmp、.git/、core.*，以re:开头时为正则表达式，可以重复指定")
+    flag.Var(&filterFlag{filter: transferFilter, kind: "exclude-from"}, "exclude-from", "从文件中读取排除规则，格式同.gitignore，以!开头的为包含规则")
+}
+
 // 定义全局变量
 var globalWait sync.WaitGroup   // 等待多个文件上传或下载完
+var ftpClient *client.Client    // 文件传输客户端
+var progress *progressView      // 传输进度显示，为nil时不显示
 
 // 定义命令行参数对应的变量
 var serverIP = flag.String("serverIP", "127.0.0.1", "服务IP")
 var serverPort = flag.Int("serverPort", 800, "服务端口")
-var action = flag.String("action", "", "upload, download or list")
-var uploadFilepaths = flag.String("uploadFilepaths", "", "上传文件路径,多个文件路径用空格相隔")
-var downloadFilenames = flag.String("downloadFilenames", "", "下载文件名")
-var downloadDir = flag.String("downloadDir", "/data/lhx/FtpData/download", "下载路径，默认当前目录")
-
-// 上传文件
-func uploadFile(uploadFilepath string) {
-    defer globalWait.Done()
-
-    var err error = nil
+var serverUrl = flag.String("server", "", "服务地址，如http://10.0.0.1:800，指定时不再使用serverIP和serverPort连接服务端")
+var configFilePath = flag.String("config", "", "配置文件路径，默认为用户配置目录下的ftpclient/config.toml")
+var profileName = flag.String("profile", "", "使用配置文件中的哪个profile，默认为配置文件中的default_profile")
+var credentials = flag.String("credentials", "", "访问凭据的引用，env:NAME从环境变量读取，file:PATH从文件读取")
+var sliceSize = flag.String("sliceSize", "", "新上传文件的分片大小，如4M，默认使用内置的分片大小")
+var concurrency = flag.Int("concurrency", 0, "每个文件同时传输的分片数，0表示使用默认值")
+var action = flag.String("action", "", "upload, download, list or serve")
+var uploadFilepaths fileList
+var downloadFilenames fileList
+var nulStdin = flag.Bool("0", false, "从标准输入读取以NUL分隔的文件名，如配合find -print0使用")
+var transferFilter = &common.Filter{}
+var minSize = flag.String("min-size", "", "只传输不小于该大小的文件，如1M")
+var maxSize = flag.String("max-size", "", "只传输不大于该大小的文件，如1G")
+var newerThan = flag.String("newer-than", "", "只传输在此之后修改的文件，可以是距现在的时长，如36h、7d，也可以是日期，如2026-01-02")
+var olderThan = flag.String("older-than", "", "只传输在此之前修改的文件，格式同newer-than")
+var dryRun = flag.Bool("dry-run", false, "只列出会上传或下载的文件，不实际传输")
+var recursive = flag.Bool("r", false, "递归上传目录下的所有文件，或下载服务端目录下的所有文件，保留目录结构")
+var downloadDir = flag.String("downloadDir", ".", "下载路径，默认当前目录")
+var storeDir = flag.String("storeDir", "", "服务端文件保存目录，serve时必须指定")
+var smallFileSize = flag.Int64("smallFileSize", common.SmallFileSize, "不超过该大小的文件整个上传，超过的切片上传，单位字节")
+var maxUploadSize = flag.Int64("maxUploadSize", 0, "服务端允许整个上传的最大文件大小，0表示不限制，serve时使用")
+var gracePeriod = flag.Duration("gracePeriod", common.GracePeriod*time.Second, "收到退出信号后等待进行中的分片完成的最长时间")
+var onExist = flag.String("onExist", common.OnExistOverwrite, "下载的文件已存在时的处理方式：overwrite覆盖，skip跳过，rename保存为带序号后缀的文件名")
+var maxTransfers = flag.Int("maxTransfers", common.TransferMaxNum, "所有文件同时进行的分片请求最大数量，0表示不限制")
+var smallFirst = flag.Bool("smallFirst", false, "多个文件同时传输时优先传输小文件")
+var adaptive = flag.Bool("adaptive", false, "根据观测到的时延和出错率自动调整分片并发数和新上传文件的分片大小")
+var historyFile = flag.String("historyFile", "", "自适应时保存传输统计的文件，默认保存在用户缓存目录下")
+var uploadLimit = flag.String("uploadLimit", "", "所有上传共享的限速，如10M，可以按时间段设置，如09:00-18:00=10M,0表示工作时间10MB/s，其他时间不限速")
+var downloadLimit = flag.String("downloadLimit", "", "所有下载共享的限速，格式同uploadLimit")
+var uploadFileLimit = flag.String("uploadFileLimit", "", "每个上传文件各自的限速，格式同uploadLimit")
+var downloadFileLimit = flag.String("downloadFileLimit", "", "每个下载文件各自的限速，格式同uploadLimit")
+var maxSliceRetries = flag.Int("maxSliceRetries", common.DefaultRetryPolicy().MaxSliceRetries, "每个分片最多重试的次数")
+var maxTransferRetries = flag.Int("maxTransferRetries", common.DefaultRetryPolicy().MaxTransferRetries, "每个文件所有分片合计最多重试的次数")
+var idleTimeout = flag.Duration("idleTimeout", common.DefaultRetryPolicy().IdleTimeout, "重试时距上次传输有进展超过该时间则放弃，0表示不限制")
+var output = flag.String("output", "text", "传输结果的输出格式：text或json，json时每个文件输出一行记录")
+var logLevel = flag.String("log-level", "info", "日志级别：debug、info、warn或error")
+var logFormat = flag.String("log-format", common.LogFormatText, "日志格式：text或json，日志输出到标准错误")
+var logLang = flag.String("lang", common.DetectLanguage(), "日志语言：en或zh，默认根据LANG环境变量选择")
+var quiet = flag.Bool("quiet", false, "只输出错误日志，不显示进度")
+var progressMode = flag.String("progress", progressAuto, "传输进度的显示方式：auto、bar、line或none，auto时标准错误是终端则显示进度条，否则定时输出进度行")
+var directWrite = flag.Bool("directWrite", false, "切片下载时直接写入预分配的目标文件，不生成分片文件")
 
-    // 获取文件大小，如果小于等于1M则整个文件上传，否则采用分片方式上传
-    filesize := common.GetFileSize(uploadFilepath)
-    if filesize <= common.SmallFileSize {
-        // 小文件
-        err = uploader.UploadFile(uploadFilepath)
+// 进程退出码，便于定时任务判断传输结果
+const (
+    exitOK             = 0 // 全部成功，已存在而跳过的文件也算成功
+    exitTotalFailure   = 1 // 全部失败
+    exitPartialFailure = 2 // 部分文件失败
+)
 
-    } else {
-        // 大文件，进行切片上传
-        // 这里需要判断是否是上传到一半的文件，如果是则重新加载上传器，如果不是则重新创建上传器当新文件进行上传
-        uloader := uploader.GetUploader(uploadFilepath, common.SliceBytes)
-        if uloader == nil {
-            fmt.Println("这是一个全新要上传的文件")
-            uloader = uploader.NewUploader(uploadFilepath, common.SliceBytes)
-        }
+// 单个文件的传输结果状态
+const (
+    statusOK      = "ok"
+    statusFailed  = "failed"
+    statusSkipped = "skipped"
+    statusDryRun  = "dry-run" // dry-run时会传输的文件
+)
 
-        if uloader == nil {
-            fmt.Println("创建上传器失败，上传文件失败")
-            return
-        }
+// transferResult 单个文件的传输结果，json输出时每个文件一条记录
+type transferResult struct {
+    File     string  `json:"file"`             // 文件路径或文件名
+    Target   string  `json:"target,omitempty"` // 上传时服务端保存的文件名，与文件路径相同时为空
+    Action   string  `json:"action"`           // upload或download
+    Status   string  `json:"status"`           // ok、failed、skipped或dry-run
+    Bytes    int64   `json:"bytes"`            // 文件大小
+    Duration float64 `json:"duration"`         // 耗时，秒
+    Error    string  `json:"error,omitempty"`  // 失败原因
+    Reason   string  `json:"reason,omitempty"` // 跳过的原因
+}
 
-        // 切片方式进行文件上传
-        err = uloader.UploadFileBySlice()
+// 根据传输返回的错误生成结果
+func newTransferResult(file string, action string, bytes int64, startTime time.Time, err error) transferResult {
+    result := transferResult{
+        File:     file,
+        Action:   action,
+        Status:   statusOK,
+        Bytes:    bytes,
+        Duration: time.Since(startTime).Seconds(),
+    }
+    if errors.Is(err, client.ErrSkipped) {
+        result.Status = statusSkipped
+    } else if err != nil {
+        result.Status = statusFailed
+        result.Error = err.Error()
     }
+    return result
+}
 
+// 上传文件
+func uploadFile(ctx context.Context, task uploadTask) transferResult {
+    startTime := time.Now()
+    bytes, err := ftpClient.UploadAs(ctx, task.path, task.name)
     if err != nil {
-        fmt.Printf("上传%s文件失败\n", uploadFilepath)
+        common.Logger().Error("upload.failed", "path", task.path, "err", err)
     }
+    return task.result(newTransferResult(task.path, "upload", bytes, startTime, err))
 }
 
 // 上传多个文件
-func uploadFiles(uploadFilepaths string) {
-    // 以空格方式分割要上传的文件
-    files := strings.Split(uploadFilepaths, " ")
-    for _, file := range files {
+func uploadFiles(ctx context.Context, tasks []uploadTask) []transferResult {
+    // 跳过的文件不计入进度
+    count := 0
+    for _, task := range tasks {
+        if task.skip == "" {
+            count++
+        }
+    }
+    results := make([]transferResult, len(tasks))
+    progress.start(count)
+    for i, task := range tasks {
+        if task.skip != "" {
+            results[i] = task.skipped()
+            continue
+        }
         globalWait.Add(1)
-        go uploadFile(file)
+        go func(i int, task uploadTask) {
+            defer globalWait.Done()
+            results[i] = uploadFile(ctx, task)
+        }(i, task)
     }
     globalWait.Wait()
+    progress.stop()
+    return results
 }
 
-// 获取文件基本信息，用以判断是普通类型文件还是切片类型文件
-func getFileInfo(filename string) (*common.FileInfo, error) {
-    targetUrl := common.BaseUrl + "getFileInfo?filename=" + filename
+// 下载文件
+func downloadFile(ctx context.Context, filename string, downloadDir string) transferResult {
+    startTime := time.Now()
+    bytes, err := ftpClient.Download(ctx, filename, downloadDir)
+    if err != nil && !errors.Is(err, client.ErrSkipped) {
+        common.Logger().Error("download.failed", "file", filename, "err", err)
+    }
+    return newTransferResult(filename, "download", bytes, startTime, err)
+}
 
-    req, _ := http.NewRequest("GET", targetUrl, nil)
-    resp, err := (&http.Client{}).Do(req)
-    if err != nil {
-        fmt.Println(err)
-        return nil, err
+// 下载多个文件
+func downloadFiles(ctx context.Context, tasks []downloadTask, downloadDir string) []transferResult {
+    if !common.IsDir(downloadDir) {
+        common.Logger().Error("download.dir_not_exist", "dir", downloadDir)
+        os.Exit(-1)
     }
-    defer resp.Body.Close()
 
-    var baseInfo common.FileInfo
-    err = json.NewDecoder(resp.Body).Decode(&baseInfo)
-    if err != nil {
-        fmt.Println("获取文件基本失败")
-        return nil, err
+    // 不能下载的文件不计入进度
+    count := 0
+    for _, task := range tasks {
+        if task.err == nil {
+            count++
+        }
+    }
+    results := make([]transferResult, len(tasks))
+    progress.start(count)
+    for i, task := range tasks {
+        if task.err != nil {
+            results[i] = task.failed()
+            continue
+        }
+        globalWait.Add(1)
+        go func(i int, file string) {
+            defer globalWait.Done()
+            results[i] = downloadFile(ctx, file, downloadDir)
+        }(i, task.name)
+    }
+    globalWait.Wait()
+    progress.stop()
+    return results
+}
+
+// dry-run时列出会上传的文件，不存在的文件算作失败
+func dryRunUploads(tasks []uploadTask) []transferResult {
+    results := make([]transferResult, len(tasks))
+    for i, task := range tasks {
+        if task.skip != "" {
+            results[i] = task.skipped()
+            continue
+        }
+        var size int64
+        stat, err := os.Stat(task.path)
+        if err == nil && stat.IsDir() {
+            err = errors.New(task.path + ": is a directory, cannot upload")
+        }
+        if err == nil {
+            size = stat.Size()
+        }
+        results[i] = task.result(newTransferResult(task.path, "upload", size, time.Now(), err))
+        if err == nil {
+            results[i].Status = statusDryRun
+        }
     }
+    return results
+}
 
-    return &baseInfo, nil
+// dry-run时列出会下载的文件，服务端不存在的文件算作失败
+func dryRunDownloads(ctx context.Context, tasks []downloadTask) []transferResult {
+    results := make([]transferResult, len(tasks))
+    for i, task := range tasks {
+        if task.err != nil {
+            results[i] = task.failed()
+            continue
+        }
+        name := task.name
+        var size int64
+        _, err := common.SafeJoin(*downloadDir, "filename", name)
+        if err == nil {
+            var fileInfo *common.FileInfo
+            fileInfo, err = ftpClient.Stat(ctx, name)
+            if err == nil {
+                size = fileInfo.Filesize
+            }
+        }
+        results[i] = newTransferResult(name, "download", size, time.Now(), err)
+        if err == nil {
+            results[i].Status = statusDryRun
+        }
+    }
+    return results
 }
 
-// 下载文件
-func downloadFile(filename string, downloadDir string) {
-    defer globalWait.Done()
+// 输出每个文件的传输结果，返回对应的退出码
+func reportResults(results []transferResult) int {
+    failed := 0
+    for _, result := range results {
+        if result.Status == statusFailed {
+            failed++
+        }
+    }
+
+    if *output == "json" {
+        encoder := json.NewEncoder(os.Stdout)
+        for _, result := range results {
+            encoder.Encode(result)
+        }
+    } else {
+        fmt.Printf("%-8s  %-12s  %-10s  %s\n", "status", "bytes", "duration", "file")
+        for _, result := range results {
+            file := result.File
+            if result.Target != "" {
+                file += " -> " + result.Target
+            }
+            fmt.Printf("%-8s  %-12d  %-10s  %s\n", result.Status, result.Bytes,
+                time.Duration(result.Duration*float64(time.Second)).Round(time.Millisecond), file)
+            if result.Error != "" {
+                fmt.Printf("          %s: %s\n", common.Translate(*logLang, "cli.error"), result.Error)
+            }
+            if result.Reason != "" {
+                fmt.Printf("          %s: %s\n", common.Translate(*logLang, "cli.reason"), result.Reason)
+            }
+        }
+        fmt.Printf(common.Translate(*logLang, "cli.summary")+"\n", len(results), failed)
+    }
+
+    switch {
+    case failed == 0:
+        return exitOK
+    case failed == len(results):
+        return exitTotalFailure
+    default:
+        return exitPartialFailure
+    }
+}
 
-    fileInfo, err := getFileInfo(filename)
+// listFiles 列出文件列表
+func listFiles(ctx context.Context) int {
+    fileinfos, err := ftpClient.List(ctx)
     if err != nil {
-        fmt.Printf("%s文件下载失败", filename)
-        return
+        return exitTotalFailure
     }
 
-    switch fileInfo.Filetype {
-    case "normal":
-        // 普通文件，直接整个下载
-        err := downloader.DownloadFile(filename, downloadDir)
-        if err != nil {
-            fmt.Printf("%s文件下载失败", filename)
+    // 只列出匹配参数中模式的文件，模式匹配目录时列出目录下的所有文件；
+    // 列表也按过滤条件筛选，规则按完整的相对路径匹配
+    patterns := flag.Args()
+    files := fileinfos.Files[:0]
+    for _, fileinfo := range fileinfos.Files {
+        matched := len(patterns) == 0
+        for _, pattern := range patterns {
+            if _, ok := matchRemote(pattern, fileinfo.Filename, true); ok {
+                matched = true
+                break
+            }
         }
-    case "slice":
-        // 切片文件
-        // 这里需要判断是否是下载到一半的文件，如果是则重新加载下载器，如果不是则重新创建下载器进行下载
-        dLoader := downloader.GetDownLoader(filename, downloadDir)
-        if dLoader == nil {
-            fmt.Printf("%s这是一个全新要下载的文件\n", filename)
-            dLoader = downloader.NewDownLoader(filename, downloadDir)
+        if matched && filterMatch(transferFilter, fileinfo.Filename, fileinfo.Filesize, fileinfo.ModifyTime) {
+            files = append(files, fileinfo)
         }
-        if dLoader == nil {
-            fmt.Printf("%s文件下载失败", filename)
+    }
+    fileinfos.Files = files
+
+    if *output == "json" {
+        encoder := json.NewEncoder(os.Stdout)
+        for _, fileinfo := range fileinfos.Files {
+            encoder.Encode(fileinfo)
         }
-        dLoader.DownloadFileBySlice()
+        return exitOK
+    }
 
-        // 合并分片
-        dLoader.MergeDownloadFiles()
-    default:
-        fmt.Printf("%s未知的文件类型，下载失败\n", filename)
+    fmt.Printf("%s      %s\n", common.Translate(*logLang, "cli.list_name"), common.Translate(*logLang, "cli.list_size"))
+    for _, fileinfo := range fileinfos.Files {
+        fmt.Printf("%s      %d\n", fileinfo.Filename, fileinfo.Filesize)
     }
+    return exitOK
 }
 
-// 下载多个文件
-func downloadFiles(filePaths string, downloadDir string) {
-    if !common.IsDir(downloadDir) {
-        fmt.Println("路径不存在", downloadDir)
+// 获取要传输的文件，没有指定或读取文件列表失败时退出
+func mustTransferFiles(list fileList) []string {
+    files, err := transferFiles(list)
+    if err != nil {
+        common.Logger().Error("cli.no_files", "err", err)
         os.Exit(-1)
     }
+    return files
+}
 
-    files := strings.Split(filePaths, " ")
-    for _, file := range files {
-        globalWait.Add(1)
-        go downloadFile(file, downloadDir)
+// 启动服务端
+func serve() {
+    if *storeDir == "" {
+        common.Logger().Error("cli.invalid_flag", "flag", "storeDir", "value", *storeDir)
+        os.Exit(-1)
+    }
+    svr, err := server.NewServer(*storeDir)
+    if err != nil {
+        common.Logger().Error("server.start_failed", "err", err)
+        os.Exit(-1)
+    }
+    svr.MaxUploadSize = *maxUploadSize
+
+    err = svr.ListenAndServe(fmt.Sprintf("%s:%d", *serverIP, *serverPort))
+    if err != nil {
+        common.Logger().Error("server.stopped", "err", err)
+        os.Exit(-1)
     }
-    globalWait.Wait()
 }
 
-// listFiles 列出文件列表
-func listFiles() {
-    targetUrl := common.BaseUrl + "listFiles"
+// 设置大小和修改时间过滤条件，格式错误时退出
+func setFilter() {
+    var err error
+    for _, size := range []struct {
+        name  string
+        value string
+        limit *int64
+    }{{"min-size", *minSize, &transferFilter.MinSize}, {"max-size", *maxSize, &transferFilter.MaxSize}} {
+        if size.value == "" {
+            continue
+        }
+        *size.limit, err = common.ParseSize(size.value)
+        if err != nil {
+            common.Logger().Error("cli.invalid_flag", "flag", size.name, "value", size.value, "err", err)
+            os.Exit(-1)
+        }
+    }
+    for _, t := range []struct {
+        name  string
+        value string
+        limit *time.Time
+    }{{"newer-than", *newerThan, &transferFilter.NewerThan}, {"older-than", *olderThan, &transferFilter.OlderThan}} {
+        if t.value == "" {
+            continue
+        }
+        *t.limit, err = parseTimeFlag(t.value)
+        if err != nil {
+            common.Logger().Error("cli.invalid_flag", "flag", t.name, "value", t.value, "err", err)
+            os.Exit(-1)
+        }
+    }
+}
 
-    req, _ := http.NewRequest("GET", targetUrl, nil)
-    resp, err := (&http.Client{}).Do(req)
+// 解析限速参数，格式错误时退出
+func parseRateSchedule(name string, value string) *common.RateSchedule {
+    schedule, err := common.ParseRateSchedule(value)
     if err != nil {
-        fmt.Println("获取文件列表信息失败", err.Error())
+        common.Logger().Error("cli.invalid_flag", "flag", name, "err", err)
+        os.Exit(-1)
+    }
+    return schedule
+}
+
+// 设置上传下载的限速
+func setRateLimits() {
+    ftpClient.UploadRate = common.NewRateLimiter(parseRateSchedule("uploadLimit", *uploadLimit))
+    ftpClient.DownloadRate = common.NewRateLimiter(parseRateSchedule("downloadLimit", *downloadLimit))
+    ftpClient.UploadFileRate = parseRateSchedule("uploadFileLimit", *uploadFileLimit)
+    ftpClient.DownloadFileRate = parseRateSchedule("downloadFileLimit", *downloadFileLimit)
+}
+
+// 按参数设置传输进度的显示，只在上传下载时显示，quiet时默认不显示
+func setProgress() {
+    mode := *progressMode
+    switch mode {
+    case progressAuto, progressBar, progressLine, progressNone:
+    default:
+        common.Logger().Error("cli.invalid_flag", "flag", "progress", "value", mode)
+        os.Exit(-1)
+    }
+    if *action != "upload" && *action != "download" {
         return
     }
-    defer resp.Body.Close()
+    if *quiet && mode == progressAuto {
+        mode = progressNone
+    }
+    progress = newProgressView(mode, os.Stderr)
+}
 
-    var fileinfos common.ListFileInfos
-    err = json.NewDecoder(resp.Body).Decode(&fileinfos)
+// 按日志参数设置默认日志，日志输出到标准错误，标准输出只有传输结果
+func setLogger() {
+    level, err := common.ParseLogLevel(*logLevel)
     if err != nil {
-        fmt.Println("获取文件列表信息失败")
-        return
+        common.Logger().Error("cli.invalid_flag", "flag", "log-level", "value", *logLevel)
+        os.Exit(-1)
+    }
+    if *quiet {
+        level = slog.LevelError
+    }
+    var out io.Writer = os.Stderr
+    if progress != nil {
+        out = progress
     }
+    logger, err := common.NewLogger(out, *logFormat, level, *logLang)
+    if err != nil {
+        common.Logger().Error("cli.invalid_flag", "flag", "log-format", "value", *logFormat)
+        os.Exit(-1)
+    }
+    common.SetLogger(logger)
+}
 
-    fmt.Printf("%s      %s\n", "文件名", "文件大小")
-    for _, fileinfo := range fileinfos.Files {
-        fmt.Printf("%s      %d\n", fileinfo.Filename, fileinfo.Filesize)
+// 设置凭据、分片大小和并发数，格式错误时退出
+func setTransferOptions() {
+    token, err := resolveCredentials(*credentials)
+    if err != nil {
+        common.Logger().Error("cli.invalid_flag", "flag", "credentials", "err", err)
+        os.Exit(-1)
+    }
+    ftpClient.Token = token
+
+    if *sliceSize != "" {
+        size, err := common.ParseSize(*sliceSize)
+        if err != nil || size <= 0 {
+            common.Logger().Error("cli.invalid_flag", "flag", "sliceSize", "value", *sliceSize)
+            os.Exit(-1)
+        }
+        ftpClient.SliceBytes = int(size)
+    }
+    if *concurrency > 0 {
+        ftpClient.UpGoroutineMaxNum = *concurrency
+        ftpClient.DpGoroutineMaxNum = *concurrency
     }
 }
 
+// 获取传输统计的保存路径，按实际访问的服务地址分开保存，
+// 服务地址无论来自--server、profile还是--serverIP/--serverPort都一样
+func transferHistoryPath(baseUrl string) string {
+    if *historyFile != "" {
+        return *historyFile
+    }
+    cacheDir, err := os.UserCacheDir()
+    if err != nil {
+        cacheDir = os.TempDir()
+    }
+    // 地址中不能用在文件名里的字符都换成-
+    key := strings.Map(func(r rune) rune {
+        if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' {
+            return r
+        }
+        return '-'
+    }, strings.TrimSuffix(baseUrl, "/"))
+    return filepath.Join(cacheDir, "FtpClient", "history-"+key+".json")
+}
+
+// 处理SIGINT/SIGTERM信号，第一次收到信号时停止调度新的分片，
+// 进行中的分片在gracePeriod内完成后保存断点续传的元数据，再次收到信号则立即退出
+func handleSignals(cancel context.CancelFunc) {
+    sigs := make(chan os.Signal, 2)
+    signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        sig := <-sigs
+        common.Logger().Warn("cli.signal", "signal", sig.String())
+        cancel()
+
+        <-sigs
+        common.Logger().Error("cli.signal_again")
+        os.Exit(130)
+    }()
+}
+
 func main() {
     startTime := time.Now()
-    defer func() {
-        fmt.Println("程序运行时间：", time.Since(startTime))
-    }()
 
     // 解析传入的参数
     flag.Parse()
+    applyConfig()
+    setProgress()
+    setLogger()
+    switch *onExist {
+    case common.OnExistOverwrite, common.OnExistSkip, common.OnExistRename:
+    default:
+        common.Logger().Error("cli.invalid_flag", "flag", "onExist", "value", *onExist)
+        os.Exit(-1)
+    }
+    switch *output {
+    case "text", "json":
+    default:
+        common.Logger().Error("cli.invalid_flag", "flag", "output", "value", *output)
+        os.Exit(-1)
+    }
 
-    // 设置基础请求URL值
-    common.BaseUrl = fmt.Sprintf("http://%s:%d/", *serverIP, *serverPort)
+    // 创建客户端
+    serverAddr := *serverUrl
+    if serverAddr == "" {
+        serverAddr = fmt.Sprintf("%s:%d", *serverIP, *serverPort)
+    }
+    ftpClient = client.NewClient(serverAddr)
+    setTransferOptions()
+    ftpClient.GracePeriod = *gracePeriod
+    ftpClient.DirectWrite = *directWrite
+    ftpClient.OnExist = *onExist
+    ftpClient.Scheduler.SetLimit(*maxTransfers)
+    ftpClient.Scheduler.SetSmallFirst(*smallFirst)
+    setRateLimits()
+    setFilter()
+    ftpClient.Retry.MaxSliceRetries = *maxSliceRetries
+    ftpClient.Retry.MaxTransferRetries = *maxTransferRetries
+    ftpClient.Retry.IdleTimeout = *idleTimeout
+    if *adaptive {
+        ftpClient.Adaptive = true
+        ftpClient.History = common.LoadTransferHistory(transferHistoryPath(ftpClient.BaseUrl))
+    }
+    ftpClient.SmallFileSize = *smallFileSize
+    if progress != nil {
+        ftpClient.Progress = progress.update
+    }
 
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    handleSignals(cancel)
+
+    exitCode := exitOK
     switch *action {
     case "upload":
         // 上传文件
-        uploadFiles(*uploadFilepaths)
+        tasks, err := uploadTasks(mustTransferFiles(uploadFilepaths), *recursive, transferFilter)
+        if err != nil {
+            common.Logger().Error("cli.expand_failed", "err", err)
+            os.Exit(-1)
+        }
+        if *dryRun {
+            exitCode = reportResults(dryRunUploads(tasks))
+            break
+        }
+        exitCode = reportResults(uploadFiles(ctx, tasks))
     case "download":
         // 下载文件
-        downloadFiles(*downloadFilenames, *downloadDir)
+        tasks, err := downloadTasks(ctx, mustTransferFiles(downloadFilenames), *recursive, transferFilter)
+        if err != nil {
+            common.Logger().Error("cli.expand_failed", "err", err)
+            os.Exit(-1)
+        }
+        if *dryRun {
+            exitCode = reportResults(dryRunDownloads(ctx, tasks))
+            break
+        }
+        exitCode = reportResults(downloadFiles(ctx, tasks, *downloadDir))
     case "list":
         // 列出文件
-        listFiles()
+        exitCode = listFiles(ctx)
+    case "serve":
+        // 启动服务端
+        serve()
     default:
-        fmt.Printf("unknow action: %s\n", *action)
+        common.Logger().Error("cli.invalid_flag", "flag", "action", "value", *action)
         os.Exit(-1)
     }
+
+    // 自适应统计在所有传输结束后保存一次
+    err := ftpClient.History.Save()
+    if err != nil {
+        common.Logger().Warn("cli.history_save_failed", "err", err)
+    }
+
+    common.Logger().Info("cli.elapsed", "elapsed", time.Since(startTime))
+    os.Exit(exitCode)
 }
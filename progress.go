@@ -0,0 +1,269 @@
+package main
+
+import (
+    "FtpClient/common"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// 进度的显示方式
+const (
+    progressAuto = "auto" // 标准错误是终端时显示进度条，否则定时输出进度行
+    progressBar  = "bar"  // 进度条
+    progressLine = "line" // 定时输出进度行
+    progressNone = "none" // 不显示进度
+)
+
+const progressBarInterval = 200 * time.Millisecond // 进度条刷新间隔
+const progressLineInterval = 5 * time.Second       // 进度行输出间隔
+const progressBarWidth = 24                        // 进度条宽度
+const progressNameWidth = 24                       // 文件名显示宽度
+
+// progressView 在标准错误上显示每个文件和所有文件合计的进度，
+// 进度条模式下日志也通过它输出，避免日志和进度条互相覆盖
+type progressView struct {
+    lock       sync.Mutex
+    out        io.Writer
+    bar        bool                        // 是否显示进度条，否则定时输出进度行
+    totalFiles int                         // 要传输的文件总数
+    files      map[string]*common.Progress // 每个文件最新的进度
+    order      []string                    // 文件开始传输的顺序
+    finished   []string                    // 已结束但还没输出结果的文件
+    drawn      int                         // 进度条模式下当前显示的行数
+    stopCh     chan struct{}
+    stopped    chan struct{}
+}
+
+// 按显示方式新建进度显示，不需要显示时返回nil
+func newProgressView(mode string, out *os.File) *progressView {
+    switch mode {
+    case progressNone:
+        return nil
+    case progressAuto:
+        mode = progressLine
+        if isTerminal(out) {
+            mode = progressBar
+        }
+    }
+    return &progressView{
+        out:     out,
+        bar:     mode == progressBar,
+        files:   make(map[string]*common.Progress),
+        stopCh:  make(chan struct{}),
+        stopped: make(chan struct{}),
+    }
+}
+
+// 判断文件是否是终端
+func isTerminal(f *os.File) bool {
+    stat, err := f.Stat()
+    if err != nil {
+        return false
+    }
+    return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// 开始定时刷新进度，totalFiles为要传输的文件总数
+func (v *progressView) start(totalFiles int) {
+    if v == nil {
+        return
+    }
+    v.totalFiles = totalFiles
+    interval := progressLineInterval
+    if v.bar {
+        interval = progressBarInterval
+    }
+
+    go func() {
+        defer close(v.stopped)
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                v.render(false)
+            case <-v.stopCh:
+                return
+            }
+        }
+    }()
+}
+
+// 停止刷新，输出还没输出的结果并清除进度条
+func (v *progressView) stop() {
+    if v == nil {
+        return
+    }
+    close(v.stopCh)
+    <-v.stopped
+    v.render(true)
+}
+
+// 接收传输进度事件，作为common.Config的Progress回调
+func (v *progressView) update(p common.Progress) {
+    v.lock.Lock()
+    defer v.lock.Unlock()
+    key := p.Action + ":" + p.Filename
+    if _, ok := v.files[key]; !ok {
+        v.order = append(v.order, key)
+    }
+    v.files[key] = &p
+    if p.Finished {
+        v.finished = append(v.finished, key)
+    }
+}
+
+// Write 进度条模式下先清除进度条，输出日志后再重新画出进度条
+func (v *progressView) Write(p []byte) (int, error) {
+    v.lock.Lock()
+    defer v.lock.Unlock()
+    if !v.bar {
+        return v.out.Write(p)
+    }
+    v.clear()
+    n, err := v.out.Write(p)
+    v.draw()
+    return n, err
+}
+
+// 刷新进度，final为true时只输出结果，不再画进度条
+func (v *progressView) render(final bool) {
+    v.lock.Lock()
+    defer v.lock.Unlock()
+
+    if v.bar {
+        v.clear()
+    }
+    // 已结束的文件输出一行结果，之后不再显示
+    for _, key := range v.finished {
+        fmt.Fprintln(v.out, formatFinished(*v.files[key]))
+    }
+    v.finished = v.finished[:0]
+    if final {
+        return
+    }
+
+    if v.bar {
+        v.draw()
+        return
+    }
+    for _, line := range v.lines() {
+        fmt.Fprintln(v.out, line)
+    }
+}
+
+// 清除进度条，调用时需要持有锁
+func (v *progressView) clear() {
+    if v.drawn > 0 {
+        // 光标上移到进度条第一行，并清除到屏幕末尾
+        fmt.Fprintf(v.out, "\x1b[%dA\x1b[J", v.drawn)
+        v.drawn = 0
+    }
+}
+
+// 画出进度条，调用时需要持有锁
+func (v *progressView) draw() {
+    lines := v.lines()
+    for _, line := range lines {
+        fmt.Fprintln(v.out, line)
+    }
+    v.drawn = len(lines)
+}
+
+// 进行中的每个文件一行进度，最后一行为所有文件合计的进度，调用时需要持有锁
+func (v *progressView) lines() []string {
+    var lines []string
+    var total common.Progress
+    done := 0
+    for _, key := range v.order {
+        p := v.files[key]
+        total.TotalBytes += p.TotalBytes
+        total.DoneBytes += p.DoneBytes
+        total.Retries += p.Retries
+        if p.Finished {
+            done++
+            continue
+        }
+        total.Rate += p.Rate
+        lines = append(lines, v.formatProgress(p.Filename, *p))
+    }
+    if len(lines) == 0 {
+        return nil
+    }
+
+    if total.Rate > 0 && total.TotalBytes > total.DoneBytes {
+        total.ETA = time.Duration(float64(total.TotalBytes-total.DoneBytes) / total.Rate * float64(time.Second))
+    }
+    totalFiles := v.totalFiles
+    if totalFiles < len(v.order) {
+        totalFiles = len(v.order)
+    }
+    name := fmt.Sprintf("%s %d/%d", common.Translate(*logLang, "cli.progress_total"), done, totalFiles)
+    return append(lines, v.formatProgress(name, total))
+}
+
+// 格式化一行进度
+func (v *progressView) formatProgress(name string, p common.Progress) string {
+    fields := []string{padName(name)}
+    percent := p.Percent()
+    if percent >= 0 {
+        if v.bar {
+            filled := int(percent / 100 * progressBarWidth)
+            if filled > progressBarWidth {
+                filled = progressBarWidth
+            }
+            fields = append(fields, "["+strings.Repeat("#", filled)+strings.Repeat("-", progressBarWidth-filled)+"]")
+        }
+        fields = append(fields, fmt.Sprintf("%5.1f%%", percent), formatBytes(p.DoneBytes)+"/"+formatBytes(p.TotalBytes))
+    } else {
+        fields = append(fields, formatBytes(p.DoneBytes))
+    }
+    fields = append(fields, formatBytes(int64(p.Rate))+"/s")
+    if p.ETA > 0 {
+        fields = append(fields, "ETA "+p.ETA.Round(time.Second).String())
+    }
+    if p.TotalSlices > 0 {
+        fields = append(fields, fmt.Sprintf("%s %d/%d", common.Translate(*logLang, "cli.progress_slices"), p.DoneSlices, p.TotalSlices))
+    }
+    if p.Retries > 0 {
+        fields = append(fields, fmt.Sprintf("%s %d", common.Translate(*logLang, "cli.progress_retries"), p.Retries))
+    }
+    return strings.Join(fields, "  ")
+}
+
+// 格式化已结束文件的结果
+func formatFinished(p common.Progress) string {
+    if p.Err != nil {
+        return fmt.Sprintf("%s  %s: %s", padName(p.Filename), common.Translate(*logLang, "cli.error"), p.Err)
+    }
+    return fmt.Sprintf("%s  %s  %s", padName(p.Filename), formatBytes(p.DoneBytes), p.Elapsed.Round(time.Millisecond))
+}
+
+// 文件名截断或补齐到固定宽度，避免进度条换行
+func padName(name string) string {
+    runes := []rune(name)
+    if len(runes) > progressNameWidth {
+        return string(runes[:progressNameWidth-3]) + "..."
+    }
+    return name + strings.Repeat(" ", progressNameWidth-len(runes))
+}
+
+// 按1024进制格式化字节数
+func formatBytes(n int64) string {
+    const unit = 1024
+    if n < unit {
+        return fmt.Sprintf("%dB", n)
+    }
+    value := float64(n)
+    for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+        value /= unit
+        if value < unit || suffix == "TiB" {
+            return fmt.Sprintf("%.1f%s", value, suffix)
+        }
+    }
+    return ""
+}
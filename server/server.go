@@ -0,0 +1,810 @@
+package server
+
+import (
+	"FtpClient/common"
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 服务端自己的数据都保存在存储目录下这一个保留的目录中，不会出现在文件列表中，
+// 用户的文件除了这个顶层名称外都可以使用，包括以.开头的文件名
+const stateDirName = ".ftpserver"
+const metaDirName = "meta"            // 保留目录下切片文件元数据保存目录
+const sliceDirName = "slices"         // 保留目录下上传中的分片保存目录
+const tmpDirName = "tmp"              // 保留目录下整个上传和合并时的临时文件目录
+const uploadingMetaName = ".metadata" // 分片目录下的上传元数据文件名
+
+// 老版本直接放在存储目录下的元数据和分片目录，启动时移到保留目录中
+var legacyStateDirs = map[string]string{".meta": metaDirName, ".slices": sliceDirName}
+
+const maxMultipartOverhead = 64 * 1024 // 整个上传时允许的multipart头尾长度
+
+// Server 文件服务端，实现客户端用到的全部接口
+type Server struct {
+	StoreDir      string       // 文件保存目录
+	MaxUploadSize int64        // 整个文件上传允许的最大文件大小，0表示不限制
+	Logger        *slog.Logger // 日志，为nil时使用common.Logger()
+	mergeLock     sync.Mutex   // 合并分片时加锁，防止同一文件被重复合并
+}
+
+// NewServer 新建一个服务端，storeDir不存在时会自动创建
+func NewServer(storeDir string) (*Server, error) {
+	stateDir := filepath.Join(storeDir, stateDirName)
+	err := os.MkdirAll(stateDir, 0766)
+	if err != nil {
+		common.Logger().Error("server.mkdir_failed", "dir", stateDir, "err", err)
+		return nil, err
+	}
+	for legacy, name := range legacyStateDirs {
+		legacyDir := filepath.Join(storeDir, legacy)
+		if common.IsDir(legacyDir) && !common.IsDir(filepath.Join(stateDir, name)) {
+			err = os.Rename(legacyDir, filepath.Join(stateDir, name))
+			if err != nil {
+				common.Logger().Error("server.mkdir_failed", "dir", legacyDir, "err", err)
+				return nil, err
+			}
+		}
+	}
+
+	for _, name := range []string{metaDirName, sliceDirName, tmpDirName} {
+		dir := filepath.Join(stateDir, name)
+		err := os.MkdirAll(dir, 0766)
+		if err != nil {
+			common.Logger().Error("server.mkdir_failed", "dir", dir, "err", err)
+			return nil, err
+		}
+	}
+
+	return &Server{
+		StoreDir: storeDir,
+	}, nil
+}
+
+// Handler 返回注册了全部接口的http.Handler
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", s.upload)
+	mux.HandleFunc("/startUploadSlice", s.startUploadSlice)
+	mux.HandleFunc("/uploadBySlice", s.uploadBySlice)
+	mux.HandleFunc("/getUploadingStat", s.getUploadingStat)
+	mux.HandleFunc("/mergeSlice", s.mergeSlice)
+	mux.HandleFunc("/getFileInfo", s.getFileInfo)
+	mux.HandleFunc("/getFileMetainfo", s.getFileMetainfo)
+	mux.HandleFunc("/download", s.download)
+	mux.HandleFunc("/downloadBySlice", s.downloadBySlice)
+	mux.HandleFunc("/checkFileExist", s.checkFileExist)
+	mux.HandleFunc("/listFiles", s.listFiles)
+	mux.HandleFunc("/delete", s.delete)
+	mux.HandleFunc("/capabilities", s.capabilities)
+	return mux
+}
+
+// ListenAndServe 在addr上启动服务
+func (s *Server) ListenAndServe(addr string) error {
+	s.log().Info("server.start", "addr", addr, "store", s.StoreDir)
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+// 获取服务端使用的日志
+func (s *Server) log() *slog.Logger {
+	if s.Logger == nil {
+		return common.Logger()
+	}
+	return s.Logger
+}
+
+// 检查文件名或fid是否合法，不允许包含路径，也不允许是.或..
+func validName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	return !strings.ContainsAny(name, "/\\\x00")
+}
+
+// 检查以/分隔的相对路径是否合法，每一级都要符合validName，文件可以保存在子目录下，
+// 第一级不能是服务端的保留目录
+func validPath(name string) bool {
+	if name == "" || name == stateDirName || strings.HasPrefix(name, stateDirName+"/") {
+		return false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !validName(elem) {
+			return false
+		}
+	}
+	return true
+}
+
+// 文件保存路径
+func (s *Server) filePath(filename string) string {
+	return filepath.Join(s.StoreDir, filepath.FromSlash(filename))
+}
+
+// 切片文件的元数据保存路径，子目录下的文件在元数据目录下也有对应的子目录
+func (s *Server) metaPath(filename string) string {
+	return filepath.Join(s.StoreDir, stateDirName, metaDirName, filepath.FromSlash(filename)+".meta")
+}
+
+// 创建文件所在的目录
+func mkParentDir(filePath string) error {
+	return os.MkdirAll(filepath.Dir(filePath), 0766)
+}
+
+// 取表单中原始的文件名，part.FileName()只保留最后一级，会丢掉子目录
+func partFilename(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// 上传中的分片保存目录
+func (s *Server) sliceDir(fid string) string {
+	return filepath.Join(s.StoreDir, stateDirName, sliceDirName, fid)
+}
+
+// 整个上传和合并时的临时文件目录，与存储目录在同一个文件系统中，可以直接重命名
+func (s *Server) tmpDir() string {
+	return filepath.Join(s.StoreDir, stateDirName, tmpDirName)
+}
+
+// 读取gob格式的元数据
+func loadMetadata(metaPath string) (*common.FileMetadata, error) {
+	file, err := os.Open(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var metadata common.FileMetadata
+	err = gob.NewDecoder(file).Decode(&metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// 以json格式返回数据
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		common.Logger().Warn("server.write_failed", "err", err)
+	}
+}
+
+// 分片数据与客户端给出的校验值不一致
+var errChecksumMismatch = errors.New("slice checksum mismatch")
+
+// 在dir下新建一个临时文件，权限与直接创建的文件相同，重命名后就是保存的文件
+func createTemp(dir string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	err = f.Chmod(0644)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// 先写到tmpDir下的临时文件，成功后再重命名，避免留下写了一半的文件。
+// verify不为空时在重命名前调用，返回错误则丢弃写入的数据
+func writeFileAtomic(tmpDir string, filePath string, r io.Reader, verify func() error) (int64, error) {
+	f, err := createTemp(tmpDir)
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := f.Name()
+
+	n, err := io.Copy(f, r)
+	if err == nil && verify != nil {
+		err = verify()
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return n, os.Rename(tmpPath, filePath)
+}
+
+// 整个文件上传，表单字段名为filename，边读边写到磁盘，不在内存中缓存整个文件
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.MaxUploadSize > 0 {
+		if r.ContentLength > s.MaxUploadSize+maxMultipartOverhead {
+			http.Error(w, "file too large, upload it by slice", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.MaxUploadSize+maxMultipartOverhead)
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "failed to read the uploaded file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			http.Error(w, "no uploaded file found", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "filename" {
+			part.Close()
+			continue
+		}
+
+		filename := partFilename(part)
+		if !validPath(filename) {
+			http.Error(w, "invalid file name: "+filename, http.StatusBadRequest)
+			return
+		}
+
+		err = mkParentDir(s.filePath(filename))
+		if err != nil {
+			s.log().Error("server.save_failed", "file", filename, "err", err)
+			http.Error(w, "failed to create directory", http.StatusInternalServerError)
+			return
+		}
+		n, err := writeFileAtomic(s.tmpDir(), s.filePath(filename), part, nil)
+		if err != nil {
+			s.log().Error("server.save_failed", "file", filename, "err", err)
+			http.Error(w, "failed to save file", http.StatusInternalServerError)
+			return
+		}
+
+		// 覆盖了之前的切片文件，它已经是普通文件了
+		os.Remove(s.metaPath(filename))
+		s.log().Info("server.uploaded", "file", filename, "bytes", n)
+		return
+	}
+}
+
+// 解析请求中的文件元数据
+func decodeMetadata(r *http.Request) (*common.FileMetadata, error) {
+	if r.Method != http.MethodPost {
+		return nil, errors.New("only POST is allowed")
+	}
+
+	var metadata common.FileMetadata
+	err := json.NewDecoder(r.Body).Decode(&metadata)
+	if err != nil {
+		return nil, err
+	}
+	if !validName(metadata.Fid) || !validPath(metadata.Filename) {
+		return nil, errors.New("invalid file name or file ID")
+	}
+	if metadata.SliceNum <= 0 {
+		return nil, errors.New("invalid slice count")
+	}
+	return &metadata, nil
+}
+
+// 开始切片上传，创建分片保存目录并记录元数据
+func (s *Server) startUploadSlice(w http.ResponseWriter, r *http.Request) {
+	metadata, err := decodeMetadata(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sliceDir := s.sliceDir(metadata.Fid)
+	err = os.MkdirAll(sliceDir, 0766)
+	if err != nil {
+		http.Error(w, "failed to create slice directory", http.StatusInternalServerError)
+		return
+	}
+
+	err = common.StoreMetadata(filepath.Join(sliceDir, uploadingMetaName), metadata)
+	if err != nil {
+		http.Error(w, "failed to save metadata", http.StatusInternalServerError)
+		return
+	}
+	s.log().Info("server.slice_upload_start", "file", metadata.Filename, "fid", metadata.Fid, "slices", metadata.SliceNum)
+}
+
+// 返回服务端支持的功能，客户端据此选择协议
+func (s *Server) capabilities(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, common.Capabilities{
+		SliceFormats:  []string{common.SliceFormatJson, common.SliceFormatBinary},
+		MaxUploadSize: s.MaxUploadSize,
+		HashAlgos:     common.HashAlgoNames(),
+	})
+}
+
+// 解析分片上传请求，二进制格式从请求头读取文件ID、序号和校验值，请求体就是分片数据；
+// 其他情况按json格式的FilePart解析。返回的part中不包含分片数据，数据从data中读取
+func decodeSlice(r *http.Request) (part common.FilePart, data io.Reader, err error) {
+	if r.Header.Get("Content-Type") == "application/octet-stream" {
+		part.Index, err = strconv.Atoi(r.Header.Get(common.SliceIndexHeader))
+		if err != nil {
+			return part, nil, errors.New("invalid slice index")
+		}
+		part.Fid = r.Header.Get(common.SliceFidHeader)
+		part.Checksum = r.Header.Get(common.SliceChecksumHeader)
+		return part, r.Body, nil
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&part)
+	if err != nil {
+		return part, nil, errors.New("failed to decode slice: " + err.Error())
+	}
+	data = bytes.NewReader(part.Data)
+	part.Data = nil
+	return part, data, nil
+}
+
+// 接收一个文件片
+func (s *Server) uploadBySlice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	part, data, err := decodeSlice(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fid, index := part.Fid, part.Index
+	if !validName(fid) || index < 0 {
+		http.Error(w, "invalid file ID or slice index", http.StatusBadRequest)
+		return
+	}
+
+	// 只接收已通过startUploadSlice开始上传的文件片，不为未知的文件ID创建目录
+	sliceDir := s.sliceDir(fid)
+	metadata, err := loadMetadata(filepath.Join(sliceDir, uploadingMetaName))
+	if err != nil {
+		http.Error(w, "no upload in progress: "+fid, http.StatusNotFound)
+		return
+	}
+	if index >= metadata.SliceNum {
+		http.Error(w, "slice index out of range", http.StatusBadRequest)
+		return
+	}
+
+	// 边写边计算校验值，与客户端给出的不一致时拒绝该分片，客户端会重传
+	sliceHash := common.NewSliceHash()
+	verify := func() error {
+		if part.Checksum != "" && common.FormatSliceChecksum(sliceHash) != part.Checksum {
+			return errChecksumMismatch
+		}
+		return nil
+	}
+
+	_, err = writeFileAtomic(sliceDir, filepath.Join(sliceDir, strconv.Itoa(index)), io.TeeReader(data, sliceHash), verify)
+	if err == errChecksumMismatch {
+		s.log().Warn("server.slice_checksum_mismatch", "fid", fid, "slice", index)
+		// 数据在传输中损坏，告诉客户端可以重传
+		w.Header().Set(common.RetryableHeader, "true")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.log().Error("server.slice_save_failed", "fid", fid, "slice", index, "err", err)
+		http.Error(w, "failed to save slice", http.StatusInternalServerError)
+		return
+	}
+}
+
+// 已收到的分片序号
+func receivedSlices(sliceDir string) map[int]bool {
+	received := make(map[int]bool)
+	files, _ := ioutil.ReadDir(sliceDir)
+	for _, file := range files {
+		index, err := strconv.Atoi(file.Name())
+		if err != nil {
+			continue
+		}
+		received[index] = true
+	}
+	return received
+}
+
+// 计算还需上传的分片序号，格式与客户端约定一致：
+// 先列出已收到的最大序号之前缺失的分片，再列出最大序号的下一片，
+// 如果之后还有分片，则以-1结尾表示从该片之后一直到最后一片都需要上传
+func neededSlices(received map[int]bool, sliceNum int) common.SliceSeq {
+	seq := common.SliceSeq{
+		Slices: []int{},
+	}
+
+	maxIndex := -1
+	for index := range received {
+		if index > maxIndex && index < sliceNum {
+			maxIndex = index
+		}
+	}
+
+	for i := 0; i < maxIndex; i++ {
+		if !received[i] {
+			seq.Slices = append(seq.Slices, i)
+		}
+	}
+
+	next := maxIndex + 1
+	if next < sliceNum {
+		seq.Slices = append(seq.Slices, next)
+		if next+1 < sliceNum {
+			seq.Slices = append(seq.Slices, -1)
+		}
+	}
+	return seq
+}
+
+// 获取还需要上传的分片
+func (s *Server) getUploadingStat(w http.ResponseWriter, r *http.Request) {
+	fid := r.URL.Query().Get("fid")
+	if !validName(fid) {
+		http.Error(w, "invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	sliceDir := s.sliceDir(fid)
+	metadata, err := loadMetadata(filepath.Join(sliceDir, uploadingMetaName))
+	if err != nil {
+		http.Error(w, "no upload in progress: "+fid, http.StatusNotFound)
+		return
+	}
+
+	writeJson(w, neededSlices(receivedSlices(sliceDir), metadata.SliceNum))
+}
+
+// 合并分片，并按客户端选用的算法校验文件
+func (s *Server) mergeSlice(w http.ResponseWriter, r *http.Request) {
+	metadata, err := decodeMetadata(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mergeLock.Lock()
+	defer s.mergeLock.Unlock()
+
+	sliceDir := s.sliceDir(metadata.Fid)
+	uploading, err := loadMetadata(filepath.Join(sliceDir, uploadingMetaName))
+	if err != nil {
+		http.Error(w, "no upload in progress: "+metadata.Fid, http.StatusNotFound)
+		return
+	}
+
+	// 合并后必须校验整个文件，客户端没有给出校验值时拒绝合并；
+	// 开始上传时已记录了校验值的，合并时给出的校验值必须与之相同
+	algo, hashsum := metadata.Digest()
+	if hashsum == "" {
+		http.Error(w, "missing file checksum", http.StatusBadRequest)
+		return
+	}
+	if startAlgo, startHashsum := uploading.Digest(); startHashsum != "" && (startAlgo != algo || startHashsum != hashsum) {
+		s.log().Warn("server.hash_mismatch", "file", metadata.Filename, "fid", metadata.Fid, "algo", algo, "expected", startHashsum, "actual", hashsum)
+		http.Error(w, "file checksum differs from the one given when the upload started", http.StatusBadRequest)
+		return
+	}
+
+	seq := neededSlices(receivedSlices(sliceDir), metadata.SliceNum)
+	if len(seq.Slices) > 0 {
+		http.Error(w, fmt.Sprintf("upload incomplete, missing slices: %v", seq.Slices), http.StatusBadRequest)
+		return
+	}
+
+	targetPath := s.filePath(metadata.Filename)
+	err = mkParentDir(targetPath)
+	if err == nil {
+		err = mkParentDir(s.metaPath(metadata.Filename))
+	}
+	if err != nil {
+		http.Error(w, "failed to create directory", http.StatusInternalServerError)
+		return
+	}
+	f, err := createTemp(s.tmpDir())
+	if err != nil {
+		http.Error(w, "failed to create file", http.StatusInternalServerError)
+		return
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	// 按分片顺序合并，同时计算校验值
+	hashAlgo, err := common.GetHashAlgo(algo)
+	if err != nil {
+		f.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fileHash := hashAlgo.New()
+	writer := io.MultiWriter(f, fileHash)
+	var filesize int64
+	for i := 0; i < metadata.SliceNum; i++ {
+		sliceFile, err := os.Open(filepath.Join(sliceDir, strconv.Itoa(i)))
+		if err != nil {
+			f.Close()
+			http.Error(w, fmt.Sprintf("failed to read slice %d", i), http.StatusInternalServerError)
+			return
+		}
+		n, err := io.Copy(writer, sliceFile)
+		sliceFile.Close()
+		if err != nil {
+			f.Close()
+			http.Error(w, fmt.Sprintf("failed to merge slice %d", i), http.StatusInternalServerError)
+			return
+		}
+		filesize += n
+	}
+	f.Close()
+
+	if metadata.Filesize > 0 && filesize != metadata.Filesize {
+		http.Error(w, fmt.Sprintf("file size mismatch, expected %d, got %d", metadata.Filesize, filesize), http.StatusBadRequest)
+		return
+	}
+
+	calHashsum := hex.EncodeToString(fileHash.Sum(nil))
+	if calHashsum != hashsum {
+		s.log().Warn("server.hash_mismatch", "file", metadata.Filename, "fid", metadata.Fid, "algo", algo, "expected", hashsum, "actual", calHashsum)
+		http.Error(w, "file "+algo+" checksum mismatch", http.StatusBadRequest)
+		return
+	}
+
+	// 下载时按上传的切片大小来切分，老客户端没有传切片大小则使用第一片的大小
+	if metadata.SliceBytes <= 0 {
+		metadata.SliceBytes = common.SliceBytes
+		if fh, err := os.Stat(filepath.Join(sliceDir, "0")); err == nil && metadata.SliceNum > 1 {
+			metadata.SliceBytes = int(fh.Size())
+		}
+	}
+	metadata.Filesize = filesize
+	metadata.SetDigest(algo, calHashsum)
+
+	err = common.StoreMetadata(s.metaPath(metadata.Filename), metadata)
+	if err != nil {
+		http.Error(w, "failed to save metadata", http.StatusInternalServerError)
+		return
+	}
+	err = os.Rename(tmpPath, targetPath)
+	if err != nil {
+		os.Remove(s.metaPath(metadata.Filename))
+		http.Error(w, "failed to save file", http.StatusInternalServerError)
+		return
+	}
+
+	os.RemoveAll(sliceDir)
+	s.log().Info("server.merged", "file", metadata.Filename, "fid", metadata.Fid, "bytes", filesize)
+}
+
+// 获取文件信息
+func (s *Server) fileInfo(filename string) (*common.FileInfo, error) {
+	if !validPath(filename) {
+		return nil, errors.New("invalid file name")
+	}
+
+	fh, err := os.Stat(s.filePath(filename))
+	if err != nil || fh.IsDir() {
+		return nil, errors.New("file not found")
+	}
+
+	info := &common.FileInfo{
+		Filename:   filename,
+		Filesize:   fh.Size(),
+		Filetype:   "normal",
+		ModifyTime: fh.ModTime(),
+	}
+	if common.IsFile(s.metaPath(filename)) {
+		info.Filetype = "slice"
+	}
+	return info, nil
+}
+
+// 获取文件基本信息
+func (s *Server) getFileInfo(w http.ResponseWriter, r *http.Request) {
+	info, err := s.fileInfo(r.URL.Query().Get("filename"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJson(w, info)
+}
+
+// 获取切片文件的元数据
+func (s *Server) getFileMetainfo(w http.ResponseWriter, r *http.Request) {
+	filename := r.URL.Query().Get("filename")
+	if !validPath(filename) {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := loadMetadata(s.metaPath(filename))
+	if err != nil {
+		http.Error(w, "file not found or not a sliced file", http.StatusNotFound)
+		return
+	}
+	writeJson(w, metadata)
+}
+
+// 整个文件下载
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	filename := r.URL.Query().Get("filename")
+	if _, err := s.fileInfo(filename); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(s.filePath(filename))
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	fh, err := f.Stat()
+	if err != nil {
+		http.Error(w, "failed to read file", http.StatusInternalServerError)
+		return
+	}
+	// ServeContent会处理Range和If-Range，客户端据此续传
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", fh.Size(), fh.ModTime().UnixNano()))
+	http.ServeContent(w, r, filename, fh.ModTime(), f)
+}
+
+// 按分片下载
+func (s *Server) downloadBySlice(w http.ResponseWriter, r *http.Request) {
+	filename := r.URL.Query().Get("filename")
+	if !validPath(filename) {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := loadMetadata(s.metaPath(filename))
+	if err != nil {
+		http.Error(w, "file not found or not a sliced file", http.StatusNotFound)
+		return
+	}
+
+	sliceIndex, err := strconv.Atoi(r.URL.Query().Get("sliceIndex"))
+	if err != nil || sliceIndex < 0 || sliceIndex >= metadata.SliceNum {
+		http.Error(w, "invalid slice index", http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(s.filePath(filename))
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	offset := int64(sliceIndex) * int64(metadata.SliceBytes)
+	length := int64(metadata.SliceBytes)
+	if offset+length > metadata.Filesize {
+		length = metadata.Filesize - offset
+	}
+
+	// 先计算分片校验值放到响应头中，客户端据此校验收到的分片
+	sliceHash := common.NewSliceHash()
+	_, err = io.Copy(sliceHash, io.NewSectionReader(f, offset, length))
+	if err != nil {
+		http.Error(w, "failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set(common.SliceChecksumHeader, common.FormatSliceChecksum(sliceHash))
+	_, err = io.Copy(w, io.NewSectionReader(f, offset, length))
+	if err != nil {
+		s.log().Warn("server.slice_send_failed", "file", filename, "slice", sliceIndex, "err", err)
+	}
+}
+
+// 检查切片文件是否还存在，且文件ID没有变化
+func (s *Server) checkFileExist(w http.ResponseWriter, r *http.Request) {
+	filename := r.URL.Query().Get("filename")
+	fid := r.URL.Query().Get("fid")
+	if !validPath(filename) {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := loadMetadata(s.metaPath(filename))
+	if err != nil || metadata.Fid != fid || !common.IsFile(s.filePath(filename)) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+}
+
+// 列出文件列表，包括子目录下的文件，文件名为以/分隔的相对路径，服务端的保留目录不列出
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request) {
+	fileinfos := common.ListFileInfos{
+		Files: []common.FileInfo{},
+	}
+	err := filepath.WalkDir(s.StoreDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if filePath == s.StoreDir {
+			return err
+		}
+		// 读取失败的子目录和服务端的保留目录跳过
+		if err != nil || filePath == filepath.Join(s.StoreDir, stateDirName) {
+			if entry != nil && entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.StoreDir, filePath)
+		if err != nil {
+			return nil
+		}
+		info, err := s.fileInfo(filepath.ToSlash(rel))
+		if err != nil {
+			return nil
+		}
+		fileinfos.Files = append(fileinfos.Files, *info)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "failed to list files", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(fileinfos.Files, func(i, j int) bool {
+		return fileinfos.Files[i].Filename < fileinfos.Files[j].Filename
+	})
+
+	writeJson(w, fileinfos)
+}
+
+// 删除文件及其元数据
+func (s *Server) delete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "only POST or DELETE is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filename := r.URL.Query().Get("filename")
+	if _, err := s.fileInfo(filename); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	s.mergeLock.Lock()
+	defer s.mergeLock.Unlock()
+
+	err := os.Remove(s.filePath(filename))
+	if err != nil {
+		http.Error(w, "failed to delete file", http.StatusInternalServerError)
+		return
+	}
+	os.Remove(s.metaPath(filename))
+	s.log().Info("server.deleted", "file", filename)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"FtpClient/common"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// 向服务端发送请求，返回状态码
+func serve(t *testing.T, handler http.Handler, req *http.Request) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Code
+}
+
+// 以json格式发送文件元数据的请求
+func metadataRequest(t *testing.T, path string, metadata *common.FileMetadata) *http.Request {
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+}
+
+// 二进制格式的分片上传请求
+func sliceRequest(fid string, index int, data []byte) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/uploadBySlice", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(common.SliceFidHeader, fid)
+	req.Header.Set(common.SliceIndexHeader, strconv.Itoa(index))
+	req.Header.Set(common.SliceChecksumHeader, common.SliceChecksum(data))
+	return req
+}
+
+func TestUploadBySliceUnknownFid(t *testing.T) {
+	srv, err := NewServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := serve(t, srv.Handler(), sliceRequest("unknown", 0, []byte("data")))
+	if code != http.StatusNotFound {
+		t.Fatalf("uploadBySlice for unknown fid = %d, want %d", code, http.StatusNotFound)
+	}
+	if _, err := os.Stat(srv.sliceDir("unknown")); !os.IsNotExist(err) {
+		t.Errorf("slice directory created for unknown fid: %v", err)
+	}
+}
+
+func TestMergeSliceVerifiesChecksum(t *testing.T) {
+	data := []byte("hello, sliced world")
+	sum := md5.Sum(data)
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		startHash string // 开始上传时给出的校验值
+		mergeHash string // 合并时给出的校验值
+		want      int
+	}{
+		{"missing checksum", "", "", http.StatusBadRequest},
+		{"wrong checksum", "", "00000000000000000000000000000000", http.StatusBadRequest},
+		{"differs from start", digest, "00000000000000000000000000000000", http.StatusBadRequest},
+		{"checksum given at merge", "", digest, http.StatusOK},
+		{"checksum given at start", digest, digest, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storeDir := t.TempDir()
+			srv, err := NewServer(storeDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := srv.Handler()
+
+			metadata := &common.FileMetadata{Fid: "fid", Filename: "a.txt", Filesize: int64(len(data)), SliceNum: 1}
+			if tt.startHash != "" {
+				metadata.SetDigest(common.HashMd5, tt.startHash)
+			}
+			if code := serve(t, handler, metadataRequest(t, "/startUploadSlice", metadata)); code != http.StatusOK {
+				t.Fatalf("startUploadSlice = %d", code)
+			}
+			if code := serve(t, handler, sliceRequest("fid", 0, data)); code != http.StatusOK {
+				t.Fatalf("uploadBySlice = %d", code)
+			}
+
+			metadata.SetDigest(common.HashMd5, tt.mergeHash)
+			code := serve(t, handler, metadataRequest(t, "/mergeSlice", metadata))
+			if code != tt.want {
+				t.Fatalf("mergeSlice = %d, want %d", code, tt.want)
+			}
+			stored := common.IsFile(filepath.Join(storeDir, "a.txt"))
+			if stored != (tt.want == http.StatusOK) {
+				t.Errorf("file stored = %v after mergeSlice returned %d", stored, code)
+			}
+		})
+	}
+}
@@ -3,109 +3,209 @@ package uploader
 import (
 	"FtpClient/common"
 	"bytes"
-	"crypto/md5"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/google/uuid"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"math"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"sync"
+	"strconv"
 	"time"
 )
 
-// FilePart 文件片
-type FilePart struct{
-	Fid     string  // 操作文件ID，随机生成的UUID
-	Index   int     // 文件切片序号
-	Data    []byte  // 分片数据
-}
+// FilePart 文件片，定义在common中以便服务端共用
+type FilePart = common.FilePart
 
 // Uploader 上传器
 type Uploader struct {
 	common.FileMetadata    			// 文件元数据
 	common.SliceSeq          		// 需要重传的序号
-	waitGoroutine   sync.WaitGroup  // 同步goroutine
 	NewLoader       bool            // 是否是新创建的上传器
 	FilePath		string			// 上传文件路径
-	SliceBytes		int				// 切片大小
-	RetryChannel	chan *FilePart	// 重传channel通道
-	MaxGtChannel	chan struct{}	// 限制上传的goroutine的数量通道
+	Concurrency		*common.Concurrency // 限制同时上传的分片数量，开启自适应时会动态调整
 	StartTime		int64			// 上传开始时间
+	SliceFormat		string			// 分片上传格式
+	conf			*common.Config	// 客户端配置
+	transfer		*common.Transfer // 在全局调度器中的登记
+	rateLimiter		*common.RateLimiter // 这个文件的限速
+	retries			*common.RetryBudget // 这次上传的重试预算
+	abort			context.CancelFunc	// 分片不能再重试时结束整个上传
+	slices			*common.SliceTracker // 这次上传中各个分片的状态
+	progress		*common.ProgressReporter // 这次上传的进度
 }
 
-// UploadFile 单个文件的上传
-func UploadFile(filePath string) error {
-	targetUrl := common.BaseUrl + "upload"
+// UploadFile 单个文件的上传，filename为服务端保存的文件名，可以是以/分隔的相对路径，失败时按重试策略重新上传
+func UploadFile(ctx context.Context, conf *common.Config, filePath string, filename string) error {
+	var fileSize int64
+	if fileStat, err := os.Stat(filePath); err == nil {
+		fileSize = fileStat.Size()
+	}
+	progress := common.NewProgressReporter(conf.Progress, "upload", filename, "", fileSize, 0)
+
+	retries := common.NewRetryBudget(conf.Retry)
+	for {
+		progress.Restart(0)
+		err := uploadFileOnce(ctx, conf, filePath, filename, progress, retries)
+		if err == nil {
+			progress.Finish(nil)
+			return nil
+		}
+		delay, retryErr := retries.Next(0, err)
+		if retryErr != nil {
+			progress.Finish(retryErr)
+			return retryErr
+		}
+		conf.Log().Warn("upload.retry", "path", filePath, "delay", delay, "err", err)
+		progress.Retry()
+		err = common.Sleep(ctx, delay)
+		if err != nil {
+			progress.Finish(err)
+			return err
+		}
+	}
+}
+
+// 发起一次整个文件的上传
+func uploadFileOnce(ctx context.Context, conf *common.Config, filePath string, filename string, progress *common.ProgressReporter, retries *common.RetryBudget) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// 请求发出后，取消时给它留出完成的时间
+	reqCtx, reqCancel := common.GraceContext(ctx, conf.GracePeriod)
+	defer reqCancel()
+
+	targetUrl := conf.Url("upload", nil)
 
 	if !common.IsFile(filePath) {
-		fmt.Printf("filePath:%s is not exist", filePath)
-		return errors.New(filePath + "文件不存在")
+		conf.Log().Error("upload.not_exist", "path", filePath)
+		return errors.New(filePath + ": file does not exist")
 	}
 
-	filename := filepath.Base(filePath)
-	bodyBuf := &bytes.Buffer{}
-	bodyWriter := multipart.NewWriter(bodyBuf)
-	fileWriter, err := bodyWriter.CreateFormFile("filename", filename)
+	// 整个上传也占用一个全局的请求名额，拿到名额后再打开文件
+	var fileSize int64
+	if fileStat, err := os.Stat(filePath); err == nil {
+		fileSize = fileStat.Size()
+	}
+	transfer := conf.Scheduler.Register(filename, fileSize)
+	defer transfer.Done()
+	err := transfer.Acquire(ctx)
 	if err != nil {
-		fmt.Println("error writing to buffer")
 		return err
 	}
+	defer transfer.Release()
 
 	//打开文件句柄操作
 	fh, err := os.Open(filePath)
 	if err != nil {
-		fmt.Printf("error opening filePath: %s\n", filePath)
+		conf.Log().Error("upload.open_failed", "path", filePath, "err", err)
+		return err
+	}
+	fileStat, err := fh.Stat()
+	if err != nil {
+		fh.Close()
 		return err
 	}
 
-	//iocopy
-	_, err = io.Copy(fileWriter, fh)
+	boundary := multipart.NewWriter(nil).Boundary()
+	overhead, err := multipartOverhead(boundary, filename)
 	if err != nil {
+		fh.Close()
+		conf.Log().Error("upload.body_failed", "path", filePath, "err", err)
 		return err
 	}
-	contentType := bodyWriter.FormDataContentType()
-	bodyWriter.Close()
-	resp, err := http.Post(targetUrl, contentType, bodyBuf)
+
+	// 通过管道边读文件边发送，内存占用与文件大小无关
+	bodyReader, bodyWriter := io.Pipe()
+	go func() {
+		defer fh.Close()
+		mw := multipart.NewWriter(bodyWriter)
+		mw.SetBoundary(boundary)
+		fileWriter, err := mw.CreateFormFile("filename", filename)
+		if err == nil {
+			// 按全局和这个文件的限速读取文件
+			fileReader := common.LimitReader(reqCtx, fh, conf.UploadRate, common.NewRateLimiter(conf.UploadFileRate))
+			fileReader = retries.Reader(progress.Reader(fileReader))
+			_, err = io.CopyN(fileWriter, fileReader, fileStat.Size())
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(reqCtx, "POST", targetUrl, bodyReader)
 	if err != nil {
+		bodyReader.Close()
 		return err
 	}
+	// 文件大小已知，可以提前算出请求体长度，不需要使用chunked编码
+	req.ContentLength = overhead + fileStat.Size()
+	contentType := "multipart/form-data; boundary=" + boundary
+	req.Header.Set("Content-Type", contentType)
+	resp, err := conf.Do(req)
+	if err != nil {
+		return common.NetworkError("upload file", err)
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("%s文件上传失败\n", filename)
-		return errors.New("上传文件失败")
+		err := common.StatusError("upload file", resp)
+		conf.Log().Error("upload.failed", "file", filename, "err", err)
+		return err
 	}
 
-	fmt.Printf("上传文件%s成功\n", filename)
+	conf.Log().Info("upload.done", "file", filename, "bytes", fileStat.Size())
 	return nil
 }
 
-// NewUploader 新建一个上传器
-func NewUploader(filePath string, sliceBytes int) (*Uploader) {
+// 计算multipart请求体中除文件内容之外的长度
+func multipartOverhead(boundary string, filename string) (int64, error) {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	err := mw.SetBoundary(boundary)
+	if err != nil {
+		return 0, err
+	}
+	_, err = mw.CreateFormFile("filename", filename)
+	if err != nil {
+		return 0, err
+	}
+	err = mw.Close()
+	if err != nil {
+		return 0, err
+	}
+	return int64(buf.Len()), nil
+}
+
+// NewUploader 新建一个上传器，filename为服务端保存的文件名
+func NewUploader(conf *common.Config, filePath string, filename string) (*Uploader) {
+	// 开启自适应时根据最近的传输情况选择分片大小
+	sliceBytes := conf.UploadSliceBytes()
 	uuid, err := uuid.NewUUID()
 	if err != nil {
-		fmt.Println("生成UUID失败")
+		conf.Log().Error("upload.uuid_failed", "err", err)
 		return nil
 	}
 
 	fileStat, err := os.Stat(filePath)
 	if err != nil {
-		fmt.Printf("读取文件%s失败, err: %s\n", filePath, err)
+		conf.Log().Error("file.stat_failed", "path", filePath, "err", err)
 		return nil
 	}
 
 	filesize := fileStat.Size()
 	if filesize <= 0 {
-		fmt.Printf("%s文件是空文件，不能上传\n", filePath)
+		conf.Log().Error("upload.empty_file", "path", filePath)
 		return nil
 	}
 
@@ -115,10 +215,11 @@ func NewUploader(filePath string, sliceBytes int) (*Uploader) {
 	metadata := common.FileMetadata{
 		Fid:        uuid.String(),
 		Filesize:   filesize,
-		Filename:   filepath.Base(filePath),
+		Filename:   filename,
 		SliceNum:   sliceNum,
 		Md5sum:     "",
 		ModifyTime: fileStat.ModTime(),
+		SliceBytes: sliceBytes,
 	}
 
 	uloader := &Uploader{
@@ -128,27 +229,26 @@ func NewUploader(filePath string, sliceBytes int) (*Uploader) {
 		},
 		NewLoader:  	true,
 		FilePath: 		filePath,
-		SliceBytes: 	sliceBytes,
-		RetryChannel: 	make(chan *FilePart, common.UploadRetryChannelNum),
-		MaxGtChannel: 	make(chan struct{}, common.UpGoroutineMaxNumPerFile),
+		Concurrency: 	conf.NewConcurrency(conf.UpGoroutineMaxNum),
 		StartTime: 		time.Now().Unix(),
+		conf: 			conf,
 	}
 
 	err = common.StoreMetadata(getUploadMetaFile(filePath), &metadata)
 	if err != nil {
-		fmt.Println("新建上传器失败")
+		conf.Log().Error("meta.store_failed", "path", getUploadMetaFile(filePath), "err", err)
 		return nil
 	}
 	return uloader
 }
 
 // GetUploader 获取一个上传器，用以初始化之前未上传完的
-func GetUploader(filePath string, sliceBytes int) (*Uploader) {
+func GetUploader(ctx context.Context, conf *common.Config, filePath string, filename string) (*Uploader) {
 	metaPath := getUploadMetaFile(filePath)
 	if common.IsFile(metaPath) {
 		file, err := os.Open(metaPath)
 		if err != nil {
-			fmt.Println("获取元数据文件状态失败")
+			conf.Log().Warn("meta.open_failed", "path", metaPath, "err", err)
 			os.Remove(metaPath)
 			return nil
 		}
@@ -156,21 +256,22 @@ func GetUploader(filePath string, sliceBytes int) (*Uploader) {
 		var metadata common.FileMetadata
 		filedata := gob.NewDecoder(file)
 		err = filedata.Decode(&metadata)
+		file.Close()
 		if err != nil {
-			fmt.Println("格式化文件数据失败")
+			conf.Log().Warn("meta.decode_failed", "path", metaPath, "err", err)
 			os.Remove(metaPath)
 			return nil
 		}
 
 		curFileStat, err := os.Stat(filePath)
 		if err != nil {
-			fmt.Println("获取文件状态失败")
+			conf.Log().Error("file.stat_failed", "path", filePath, "err", err)
 			return nil
 		}
 
-		// 比较文件数据
-		if metadata.Filesize != curFileStat.Size() || metadata.ModifyTime != curFileStat.ModTime() {
-			fmt.Println("该文件已被修改过，全量重新上传")
+		// 比较文件数据，上次上传时保存的文件名不同也重新上传
+		if metadata.Filesize != curFileStat.Size() || metadata.ModifyTime != curFileStat.ModTime() || metadata.Filename != filename {
+			conf.Log().Info("upload.file_modified", "path", filePath)
 			os.Remove(metaPath)
 			return nil
 		}
@@ -178,19 +279,28 @@ func GetUploader(filePath string, sliceBytes int) (*Uploader) {
 		uloader := &Uploader{
 			FileMetadata:	metadata,
 			FilePath: 		filePath,
-			SliceBytes: 	sliceBytes,
 			NewLoader: 		false,
-			RetryChannel: 	make(chan *FilePart, common.UploadRetryChannelNum),
-			MaxGtChannel: 	make(chan struct{}, common.UpGoroutineMaxNumPerFile),
+			Concurrency: 	conf.NewConcurrency(conf.UpGoroutineMaxNum),
 			StartTime: 		time.Now().Unix(),
+			conf: 			conf,
+		}
+		// 老版本的元数据没有记录切片大小，只能使用配置的值
+		if uloader.SliceBytes <= 0 {
+			uloader.SliceBytes = conf.SliceBytes
 		}
 
 		// 获取服务端需要我们重传的分片
-		sliceSeq, err := uloader.getRetrySlice(metadata.Fid, metadata.Filename)
+		sliceSeq, err := uloader.getRetrySlice(ctx, metadata.Fid, metadata.Filename)
 		if err != nil {
 			sliceSeq = &common.SliceSeq{
 				Slices: []int{-1},
 			}
+			// 服务端没有这次上传的记录，如已清理或换了服务端，重新开始上传
+			var transferErr *common.TransferError
+			if errors.As(err, &transferErr) && transferErr.StatusCode == http.StatusNotFound {
+				conf.Log().Info("upload.server_lost", "path", filePath, "fid", metadata.Fid)
+				uloader.NewLoader = true
+			}
 		}
 		uloader.SliceSeq = *sliceSeq
 		return uloader
@@ -208,41 +318,53 @@ func getUploadMetaFile(filePath string) string {
 }
 
 // 获取需要重新上传的序号，类似于SACK思想
-func (*Uploader) getRetrySlice(fid string, filename string) (*common.SliceSeq, error) {
-	targetUrl := common.BaseUrl + "getUploadingStat?fid=" + fid + "&filename=" + filename
+func (u *Uploader) getRetrySlice(ctx context.Context, fid string, filename string) (*common.SliceSeq, error) {
+	targetUrl := u.conf.Url("getUploadingStat", url.Values{"fid": {fid}, "filename": {filename}})
 
-	req, _ := http.NewRequest("GET", targetUrl, nil)
-	resp, err := (&http.Client{}).Do(req)
+	req, _ := http.NewRequestWithContext(ctx, "GET", targetUrl, nil)
+	resp, err := u.conf.Do(req)
 	if err != nil {
-		fmt.Println(err)
+		u.log().Warn("upload.stat_failed", "err", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		u.log().Warn("upload.stat_failed", "status", resp.StatusCode)
+		return nil, common.StatusError("get uploading stat", resp)
+	}
+
 	var seq common.SliceSeq
 	err = json.NewDecoder(resp.Body).Decode(&seq)
 	if err != nil {
-		fmt.Println("获取重传序号失败")
+		u.log().Warn("upload.stat_failed", "err", err)
 		return nil, err
 	}
 
-	fmt.Println("还需上传的文件片：")
-	fmt.Println(seq.Slices)
+	u.log().Info("upload.resume", "slices", seq.Slices)
 	return &seq, nil
 }
 
+// 带上文件ID和文件名的日志
+func (u *Uploader) log() *slog.Logger {
+	return u.conf.Log().With("fid", u.Fid, "file", u.Filename)
+}
+
 // 向服务端发起请求，只需判断返回值是否成功即可
 // 1.发起上传分片文件请求
 // 2.发起合并分片文件请求
-func (u *Uploader) sendCmdReq (targetUrl string) error {
+func (u *Uploader) sendCmdReq (ctx context.Context, targetUrl string) error {
 	reqBody := new(bytes.Buffer)
 	json.NewEncoder(reqBody).Encode(u.FileMetadata)
-	req, err := http.NewRequest("POST", targetUrl, reqBody)
+	req, err := http.NewRequestWithContext(ctx, "POST", targetUrl, reqBody)
+	if err != nil {
+		return err
+	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := (&http.Client{}).Do(req)
+	resp, err := u.conf.Do(req)
 	if err != nil {
-		fmt.Printf("send data error")
+		u.log().Warn("upload.command_failed", "url", targetUrl, "err", err)
 		return err
 	}
 	defer resp.Body.Close()
@@ -258,135 +380,279 @@ func (u *Uploader) sendCmdReq (targetUrl string) error {
 	return nil
 }
 
-// 重传失败的分片
-func (u *Uploader) retryUploadSlice() {
-	for part := range u.RetryChannel {
-		// 检查上传是否超时了，如果超时了则开始快速退出
-		if time.Now().Unix() - u.StartTime > common.UploadTimeout {
-			fmt.Println("上传超时，请重试")
-			u.waitGoroutine.Done()
-			continue
-		}
-
-		fmt.Printf("重传文件分片，文件名:%s, 分片序号:%d\n", u.Filename, part.Index)
-		go u.uploadSlice(part)
+// 分片上传失败，上传未被取消且还能重试时，分片回到等待状态，等待退避时间后重传，否则标记为失败
+func (u *Uploader) retryLater(ctx context.Context, reqCtx context.Context, part *FilePart, err error) {
+	if ctx.Err() != nil {
+		u.slices.Fail(part.Index)
+		return
 	}
-}
 
-// 上传文件片
-func (u *Uploader) uploadSlice(part *FilePart) error{
-	// 控制上传文件片goroutine数量
-	u.MaxGtChannel <- struct{}{}
+	// 不可重试的错误或重试次数用完时结束整个上传
+	delay, err := u.retries.Next(part.Index, err)
+	if err != nil {
+		u.log().Error("slice.give_up", "slice", part.Index, "err", err)
+		u.abort()
+		u.slices.Fail(part.Index)
+		return
+	}
 
-	defer func (){
-		<-u.MaxGtChannel
+	// 退避等待期间不占用并发名额
+	u.slices.Retry(part.Index)
+	go func() {
+		if common.Sleep(ctx, delay) != nil {
+			u.slices.Fail(part.Index)
+			return
+		}
+		u.log().Info("slice.retry", "slice", part.Index, "delay", delay)
+		u.progress.Retry()
+		err := u.acquireSlot(ctx)
+		if err != nil {
+			u.slices.Fail(part.Index)
+			return
+		}
+		defer u.releaseSlot()
+		u.uploadSlice(ctx, reqCtx, part)
 	}()
+}
 
-	targetUrl := common.BaseUrl + "uploadBySlice"
-	//fmt.Printf("fid: %s, index: %d\n", part.Fid, part.Index)
+// 构造分片上传请求，二进制格式直接以分片数据作为请求体，json格式则编码整个FilePart
+func (u *Uploader) newSliceRequest(ctx context.Context, part *FilePart) (*http.Request, error) {
+	targetUrl := u.conf.Url("uploadBySlice", nil)
+	u.log().Debug("slice.upload", "slice", part.Index, "bytes", len(part.Data))
+
+	if u.SliceFormat == common.SliceFormatBinary {
+		req, err := http.NewRequestWithContext(ctx, "POST", targetUrl, bytes.NewReader(part.Data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set(common.SliceFidHeader, part.Fid)
+		req.Header.Set(common.SliceIndexHeader, strconv.Itoa(part.Index))
+		req.Header.Set(common.SliceChecksumHeader, part.Checksum)
+		u.limitBody(ctx, req)
+		return req, nil
+	}
 
 	reqBody := new(bytes.Buffer)
 	json.NewEncoder(reqBody).Encode(part)
 
-	req, err := http.NewRequest("POST", targetUrl, reqBody)
+	req, err := http.NewRequestWithContext(ctx, "POST", targetUrl, reqBody)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Content-Type", "application/json")
+	u.limitBody(ctx, req)
+	return req, nil
+}
 
-	resp, err := (&http.Client{}).Do(req)
+// 请求体按全局和这个文件的限速发送，请求体长度已在创建请求时确定。
+// 重定向或连接断开后重发时通过GetBody重新获取的请求体同样限速
+func (u *Uploader) limitBody(ctx context.Context, req *http.Request) {
+	req.Body = ioutil.NopCloser(common.LimitReader(ctx, req.Body, u.conf.UploadRate, u.rateLimiter))
+	getBody := req.GetBody
+	if getBody == nil {
+		return
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		body, err := getBody()
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(common.LimitReader(ctx, body, u.conf.UploadRate, u.rateLimiter)), nil
+	}
+}
+
+// 获取上传一个分片的名额，先获取这个文件的并发名额，再获取所有文件共享的分片请求名额
+func (u *Uploader) acquireSlot(ctx context.Context) error {
+	err := u.Concurrency.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	err = u.transfer.Acquire(ctx)
 	if err != nil {
-		fmt.Printf("上传文件分片失败，文件ID: %s, 序号：%d, err: %s\n", part.Fid, part.Index, err.Error())
+		u.Concurrency.Release()
+		return err
+	}
+	return nil
+}
+
+// 释放acquireSlot获取的名额
+func (u *Uploader) releaseSlot() {
+	u.transfer.Release()
+	u.Concurrency.Release()
+}
+
+// 上传文件片，调用前需先通过acquireSlot获取名额。
+// ctx取消后不再开始新的请求，已发出的请求使用reqCtx，可以在宽限时间内完成
+func (u *Uploader) uploadSlice(ctx context.Context, reqCtx context.Context, part *FilePart) error{
+	// 分片已不在等待状态时不再上传，避免同一分片被重复上传
+	if !u.slices.Start(part.Index) {
+		return nil
+	}
+
+	// 记录分片的时延和结果，用于调整并发数和分片大小，取消导致的失败不计入
+	start := time.Now()
+	failed := true
+	defer func() {
+		if !failed || reqCtx.Err() == nil {
+			u.Concurrency.Observe(common.SliceSample{Bytes: int64(len(part.Data)), Latency: time.Since(start), Err: failed})
+		}
+	}()
+
+	req, err := u.newSliceRequest(reqCtx, part)
+	if err != nil {
+		u.slices.Fail(part.Index)
+		return err
+	}
+
+	resp, err := u.conf.Do(req)
+	if err != nil {
+		err = common.NetworkError("upload slice", err)
+		u.log().Warn("slice.upload_failed", "slice", part.Index, "err", err)
 		// 进行切片重传
-		u.RetryChannel <- part
+		u.retryLater(ctx, reqCtx, part, err)
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		errMsg, err := ioutil.ReadAll(resp.Body)
-		msg := string(errMsg)
-		if err != nil {
-			msg = err.Error()
-		}
-		fmt.Printf("上传文件分片失败，文件ID: %s, 序号：%d, err: %s\n", part.Fid, part.Index, msg)
-		u.RetryChannel <- part
-		return errors.New(msg)
+		err := common.StatusError("upload slice", resp)
+		u.log().Warn("slice.upload_failed", "slice", part.Index, "err", err)
+		u.retryLater(ctx, reqCtx, part, err)
+		return err
 	}
 
-	u.waitGoroutine.Done()
+	failed = false
+	u.retries.Progress()
+	if u.slices.Finish(part.Index) {
+		u.progress.SliceDone(int64(len(part.Data)))
+	}
 	return nil
 }
 
-// UploadFileBySlice 对文件切片并上传文件
-func (u *Uploader) UploadFileBySlice() error {
+// UploadFileBySlice 对文件切片并上传文件，ctx被取消后不再上传新的分片，
+// 等待已发出的分片结束后返回，元数据文件会保留下来用于断点续传
+func (u *Uploader) UploadFileBySlice(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	u.progress = common.NewProgressReporter(u.conf.Progress, "upload", u.Filename, u.Fid, u.Filesize, u.SliceNum)
+	defer func() {
+		u.progress.Finish(err)
+	}()
+
 	if u.NewLoader {
 		// 新上传的文件才需要进行初始化
-		err := u.sendCmdReq(common.BaseUrl + "startUploadSlice")
+		err := u.sendCmdReq(ctx, u.conf.Url("startUploadSlice", nil))
 		if err != nil {
-			fmt.Println(err.Error())
+			u.log().Error("upload.start_failed", "err", err)
 			os.Remove(getUploadMetaFile(u.FilePath))
 			return err
 		}
 	}
 
-	// 用来计算文件md5值
-	md5sum := u.Md5sum
+	// 文件校验值，为空时需要在读取文件的过程中计算
+	_, hashsum := u.Digest()
 
-	if len(u.Slices) == 0 && md5sum != "" {
+	if len(u.Slices) == 0 && hashsum != "" {
 		// 分片都已保存在服务端了，提出合并请求即可
-		err := u.sendCmdReq(common.BaseUrl + "mergeSlice")
+		u.progress.Skip(u.SliceNum, u.Filesize)
+		err := u.sendCmdReq(ctx, u.conf.Url("mergeSlice", nil))
 		if err != nil {
-			fmt.Println(err.Error())
+			u.log().Error("upload.merge_failed", "err", err)
 			return err
 		}
 		os.Remove(getUploadMetaFile(u.FilePath))
-		fmt.Printf("%s文件上传成功\n", u.Filename)
+		u.log().Info("upload.done", "bytes", u.Filesize)
 		return nil
 	}
 
 	//打开文件句柄操作
 	fh, err := os.Open(u.FilePath)
 	if err != nil {
-		fmt.Printf("error opening filePath: %s\n", u.FilePath)
+		u.log().Error("upload.open_failed", "path", u.FilePath, "err", err)
 		return err
 	}
 
 	defer fh.Close()
 
-	// 启动重传goroutine
-	go u.retryUploadSlice()
+	// 已发出的分片请求在取消后还可以在宽限时间内完成
+	reqCtx, reqCancel := common.GraceContext(ctx, u.conf.GracePeriod)
+	defer reqCancel()
+
+	// 根据服务端能力选择分片上传格式
+	u.SliceFormat = u.conf.UploadSliceFormat(ctx)
+
+	// 这个文件的限速和重试预算，续传时重新开始计算
+	u.rateLimiter = common.NewRateLimiter(u.conf.UploadFileRate)
+	u.retries = common.NewRetryBudget(u.conf.Retry)
+	u.abort = cancel
 
-	hash := md5.New()
+	// 登记到全局调度器，与其他文件轮流获取分片请求名额
+	u.transfer = u.conf.Scheduler.Register(u.Filename, u.Filesize)
+	defer u.transfer.Done()
+	// 记录各个分片的状态，所有分片都完成或失败后结束
+	u.slices = common.NewSliceTracker()
+
+	// 还没有校验值时与服务端协商校验算法，续传的文件沿用之前选定的算法
+	if hashsum == "" && u.HashAlgo == "" {
+		u.HashAlgo = u.conf.NegotiateHashAlgo(ctx).Name()
+	}
+	hashAlgo, err := common.GetHashAlgo(u.HashAlgo)
+	if err != nil {
+		u.log().Error("hash.unsupported", "algo", u.HashAlgo, "err", err)
+		return err
+	}
+	hash := hashAlgo.New()
 
 	startIndex := 0
-	if len(u.Slices) > 0  && u.Slices[0] >= 0 && md5sum != "" {
+	if len(u.Slices) > 0  && u.Slices[0] >= 0 && hashsum != "" {
 		startIndex = u.Slices[0]
 	}
 	// 跳过无须再读取的部分
 	fh.Seek(int64(startIndex)*int64(u.SliceBytes), 0)
+	u.progress.Skip(startIndex, int64(startIndex)*int64(u.SliceBytes))
+
+	var readErr error
+	i := startIndex
+	for ; i < u.SliceNum; i++ {
+		if ctx.Err() != nil {
+			// 已取消或不能再重试，不再上传新的分片
+			break
+		}
 
-	for i := startIndex; i < u.SliceNum; i++ {
 		tmpData := make([]byte, u.SliceBytes)
-		nr, err := fh.Read(tmpData[:])
-		if err != nil {
-			fmt.Printf("read file error\n")
-			return err
+		nr, err := io.ReadFull(fh, tmpData[:])
+		if err != nil && !(err == io.ErrUnexpectedEOF && i == u.SliceNum-1) {
+			u.log().Error("upload.read_failed", "path", u.FilePath, "slice", i, "err", err)
+			readErr = err
+			cancel()
+			break
 		}
-		if md5sum == "" {
+		if hashsum == "" {
 			hash.Write(tmpData[:nr])
 		}
 		tmpData = tmpData[:nr]
 
 		if len(u.Slices) <= 0 {
-			if md5sum == "" {
-				// 还需计算md5
+			if hashsum == "" {
+				// 还需计算校验值
+				u.progress.Skip(1, int64(nr))
 				continue
 			}
-			// 没有需要重传的了，直接跳出
+			// 没有需要重传的了，直接跳出，剩下的分片都已上传
+			u.progress.Skip(u.SliceNum-i, u.Filesize-int64(i)*int64(u.SliceBytes))
 			break
 		} else if u.Slices[0] != -1 && i != u.Slices[0] {
 			// 不需要重传的直接跳过
+			u.progress.Skip(1, int64(nr))
 			continue
 		}
 
+		// 先获取名额再读取下一片，内存中最多只有并发数加一个分片的数据
+		if u.acquireSlot(ctx) != nil {
+			break
+		}
 		if u.Slices[0] != -1 {
 			// 去掉重传的片
 			u.Slices = u.Slices[1:]
@@ -394,43 +660,60 @@ func (u *Uploader) UploadFileBySlice() error {
 
 		// 构造切片并上传
 		part := &FilePart{
-			Fid:    u.Fid,
-			Index:  i,
-			Data:   tmpData,
+			Fid:        u.Fid,
+			Index:      i,
+			Data:       tmpData,
+			Checksum:   common.SliceChecksum(tmpData),
 		}
-		u.waitGoroutine.Add(1)
-		go u.uploadSlice(part)
+		u.slices.Add(i)
+		go func() {
+			defer u.releaseSlot()
+			u.uploadSlice(ctx, reqCtx, part)
+		}()
 	}
 
-	if md5sum == "" {
-		// 计算文件md5
-		md5sum = hex.EncodeToString(hash.Sum(nil))
-		// 保存md5到元数据文件
-		u.Md5sum = md5sum
+	if hashsum == "" && i == u.SliceNum {
+		// 计算文件校验值，被取消时文件没有读完，校验值留到下次续传时再计算
+		hashsum = hex.EncodeToString(hash.Sum(nil))
+		// 保存校验值到元数据文件
+		u.SetDigest(hashAlgo.Name(), hashsum)
 		err := common.StoreMetadata(getUploadMetaFile(u.FilePath), &u.FileMetadata)
 		if err != nil {
+			cancel()
+			u.slices.Wait()
 			return err
 		}
 	}
 
-	fmt.Println("等待分片上传完成")
-	u.waitGoroutine.Wait()
-	if time.Now().Unix() - u.StartTime > common.UploadTimeout {
-		fmt.Println("上传超时，请重试")
-		return errors.New("上传超时，请重试")
+	u.log().Debug("slice.wait")
+	u.slices.Wait()
+	if readErr != nil {
+		return readErr
+	}
+	if err := u.retries.Err(); err != nil {
+		// 服务端拒绝了分片或重试次数用完，保存进度，问题解决后可以续传
+		common.StoreMetadata(getUploadMetaFile(u.FilePath), &u.FileMetadata)
+		u.log().Error("upload.failed_saved", "err", err)
+		return err
+	}
+	if ctx.Err() != nil {
+		// 保存断点续传需要的元数据，下次GetUploader时从服务端获取还需上传的分片
+		common.StoreMetadata(getUploadMetaFile(u.FilePath), &u.FileMetadata)
+		u.log().Warn("upload.interrupted", "err", ctx.Err())
+		return ctx.Err()
 	}
 
-	fmt.Println("分片都已上传完成")
+	u.log().Debug("slice.all_done")
 	// 删除元数据文件
 	defer os.Remove(getUploadMetaFile(u.FilePath))
 
 	// 发起合并请求
-	err = u.sendCmdReq(common.BaseUrl + "mergeSlice")
+	err = u.sendCmdReq(ctx, u.conf.Url("mergeSlice", nil))
 	if err != nil {
-		fmt.Println("合并文件失败，请重新上传, err:", err.Error())
+		u.log().Error("upload.merge_failed", "err", err)
 		return err
 	}
 
-	fmt.Printf("%s文件上传成功\n", u.Filename)
+	u.log().Info("upload.done", "bytes", u.Filesize)
 	return nil
-}
\ No newline at end of file
+}
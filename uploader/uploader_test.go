@@ -0,0 +1,215 @@
+package uploader
+
+import (
+	"FtpClient/common"
+	"FtpClient/internal/testserver"
+	"FtpClient/server"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 检查服务端保存的文件内容
+func checkStored(t *testing.T, storeDir string, filename string, want []byte) {
+	got, err := os.ReadFile(filepath.Join(storeDir, filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("stored %s differs from source: got %d bytes, want %d", filename, len(got), len(want))
+	}
+}
+
+func TestUploadFileBySliceRetriesFaults(t *testing.T) {
+	f := &testserver.Faults{Path: "/uploadBySlice", ServerErrors: 3, Corruptions: 3}
+	ts, storeDir := testserver.New(t, f)
+	conf := testserver.Config(ts)
+	filePath, data := testserver.WriteRandomFile(t, 10*conf.SliceBytes+123)
+
+	uloader := NewUploader(conf, filePath, "dir/big.bin")
+	if uloader == nil {
+		t.Fatal("NewUploader returned nil")
+	}
+	err := uloader.UploadFileBySlice(context.Background())
+	if err != nil {
+		t.Fatalf("UploadFileBySlice: %v", err)
+	}
+	if f.Left() != 0 {
+		t.Fatalf("%d faults were not injected", f.Left())
+	}
+	checkStored(t, storeDir, "dir/big.bin", data)
+	if common.IsFile(getUploadMetaFile(filePath)) {
+		t.Error("upload metadata left behind after a successful upload")
+	}
+}
+
+func TestUploadFileRetriesFaults(t *testing.T) {
+	f := &testserver.Faults{Path: "/upload", ServerErrors: 2}
+	ts, storeDir := testserver.New(t, f)
+	conf := testserver.Config(ts)
+	filePath, data := testserver.WriteRandomFile(t, 1000)
+
+	err := UploadFile(context.Background(), conf, filePath, "small.bin")
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if f.Left() != 0 {
+		t.Fatalf("%d faults were not injected", f.Left())
+	}
+	checkStored(t, storeDir, "small.bin", data)
+}
+
+func TestUploadFileBySliceBudgetExhausted(t *testing.T) {
+	f := &testserver.Faults{Path: "/uploadBySlice", ServerErrors: 1 << 30}
+	ts, _ := testserver.New(t, f)
+	conf := testserver.Config(ts)
+	conf.Retry.MaxTransferRetries = 5
+	filePath, _ := testserver.WriteRandomFile(t, 4*conf.SliceBytes)
+
+	uloader := NewUploader(conf, filePath, "big.bin")
+	if uloader == nil {
+		t.Fatal("NewUploader returned nil")
+	}
+	err := uloader.UploadFileBySlice(context.Background())
+	if !errors.Is(err, common.ErrRetryBudgetExhausted) {
+		t.Fatalf("UploadFileBySlice error = %v, want ErrRetryBudgetExhausted", err)
+	}
+	// 元数据保留下来，下次可以续传
+	if !common.IsFile(getUploadMetaFile(filePath)) {
+		t.Error("upload metadata removed after a failed upload")
+	}
+}
+
+func TestUploadFileBySliceBoundsInFlightSlices(t *testing.T) {
+	srv, err := server.NewServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := srv.Handler()
+	// 分片请求阻塞到release关闭，统计同时在处理的分片请求数
+	release := make(chan struct{})
+	var lock sync.Mutex
+	inFlight := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/uploadBySlice" {
+			lock.Lock()
+			inFlight++
+			lock.Unlock()
+			<-release
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	conf := testserver.Config(ts)
+	conf.UpGoroutineMaxNum = 2
+	filePath, _ := testserver.WriteRandomFile(t, 64*conf.SliceBytes)
+	uloader := NewUploader(conf, filePath, "big.bin")
+	if uloader == nil {
+		t.Fatal("NewUploader returned nil")
+	}
+
+	base := runtime.NumGoroutine()
+	done := make(chan error, 1)
+	go func() {
+		done <- uloader.UploadFileBySlice(context.Background())
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		n := inFlight
+		lock.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d slice requests started, want 2", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// 名额用完后不再读取和启动新的分片
+	time.Sleep(50 * time.Millisecond)
+	if extra := runtime.NumGoroutine() - base; extra > 32 {
+		t.Errorf("%d goroutines started while 2 slices were in flight", extra)
+	}
+	lock.Lock()
+	if inFlight != 2 {
+		t.Errorf("%d slice requests in flight, want 2", inFlight)
+	}
+	lock.Unlock()
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("UploadFileBySlice: %v", err)
+	}
+}
+
+func TestGetUploaderRestartsWhenServerLostUpload(t *testing.T) {
+	// 第一次上传失败，留下续传用的元数据
+	f := &testserver.Faults{Path: "/uploadBySlice", ServerErrors: 1 << 30}
+	ts, _ := testserver.New(t, f)
+	conf := testserver.Config(ts)
+	conf.Retry.MaxTransferRetries = 2
+	filePath, data := testserver.WriteRandomFile(t, 4*conf.SliceBytes)
+	uloader := NewUploader(conf, filePath, "big.bin")
+	if uloader == nil {
+		t.Fatal("NewUploader returned nil")
+	}
+	if err := uloader.UploadFileBySlice(context.Background()); err == nil {
+		t.Fatal("UploadFileBySlice succeeded with a failing server")
+	}
+
+	// 新的服务端没有这次上传的记录，续传时重新开始上传
+	ts2, storeDir := testserver.New(t, &testserver.Faults{})
+	conf2 := testserver.Config(ts2)
+	uloader = GetUploader(context.Background(), conf2, filePath, "big.bin")
+	if uloader == nil {
+		t.Fatal("GetUploader returned nil")
+	}
+	if !uloader.NewLoader {
+		t.Error("GetUploader did not restart an upload unknown to the server")
+	}
+	if err := uloader.UploadFileBySlice(context.Background()); err != nil {
+		t.Fatalf("UploadFileBySlice: %v", err)
+	}
+	checkStored(t, storeDir, "big.bin", data)
+}
+
+func TestLimitBodyLimitsGetBody(t *testing.T) {
+	schedule, err := common.ParseRateSchedule("1K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &Uploader{conf: common.NewConfig("http://localhost/"), rateLimiter: common.NewRateLimiter(schedule)}
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/uploadBySlice", bytes.NewReader(make([]byte, 64*1024)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 已取消的ctx下，限速的请求体等待令牌时立即出错，没有限速的能直接读完
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	u.limitBody(ctx, req)
+	if _, err := io.ReadAll(req.Body); !errors.Is(err, context.Canceled) {
+		t.Errorf("reading Body: err = %v, want context.Canceled", err)
+	}
+	if req.GetBody == nil {
+		t.Fatal("GetBody removed")
+	}
+	// 重发时重新获取的请求体同样限速
+	body, err := req.GetBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(body); !errors.Is(err, context.Canceled) {
+		t.Errorf("reading GetBody: err = %v, want context.Canceled", err)
+	}
+}